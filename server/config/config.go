@@ -1,19 +1,27 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go_service_core/core/log"
 	"gopkg.in/yaml.v3"
+	"math"
+	"net"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 type ServiceData struct {
 	Name              string   `yaml:"name"`
-	ServerName        string   `yaml:"server_name"`
+	ServerName        string   `yaml:"server_name"` //逗号分隔的多个域名，支持 *.example.com、www.example.* 和以 ~ 开头的正则
 	ServerIp          string   `yaml:"server_ip"`
 	Port              int      `yaml:"port"`
 	StartInstancePort int      `yaml:"start_instance_port"`
@@ -24,12 +32,298 @@ type ServiceData struct {
 	DelayUpdateTime   int      `yaml:"delay_update_time"`  //有文件更新后等几秒开始重启实例
 	WatchFiles        []string `yaml:"watch_files"`
 	Enabled           bool     `yaml:"enabled"` //在启动smoothserve时，是否启动这个服务
+
+	StopTimeout int `yaml:"stop_timeout"` //实例退出后等待它进程组里其它进程退出的秒数，超时后强制杀掉，默认10
+
+	CrashHistorySize int `yaml:"crash_history_size"` //保留最近几次实例崩溃的记录，默认20
+	CrashLogLines    int `yaml:"crash_log_lines"`    //崩溃记录里保留实例最后输出的行数，默认50
+
+	Env         map[string]string `yaml:"env"`          //实例的环境变量，可以用 ${NAME} 引用 smoothserve 的环境变量
+	EnvFile     string            `yaml:"env_file"`     //.env 格式的环境变量文件，相对路径以可执行文件所在目录为根
+	SecretFiles map[string]string `yaml:"secret_files"` //变量名 -> 文件路径，文件内容作为变量值，不会出现在配置文件里
+
+	Args    []string `yaml:"args"`     //实例的命令行参数模板，如 ["serve", "--listen=:{{.Port}}"]，默认为 -port={{.Port}}
+	PortEnv string   `yaml:"port_env"` //设置后端口通过这个环境变量传给实例，没有配置 args 时不再传 -port 参数
+
+	User   string   `yaml:"user"`   //以哪个用户运行实例，用户名或uid，默认和smoothserve相同
+	Group  string   `yaml:"group"`  //以哪个组运行实例，组名或gid，默认为用户的主组
+	Groups []string `yaml:"groups"` //附加组，默认为用户所在的所有组
+	Umask  string   `yaml:"umask"`  //实例的umask，八进制，如 "0027"
+
+	Limits ResourceLimits `yaml:"limits"` //实例的资源限制
+
+	AccessLog       AccessLogConfig `yaml:"access_log"`        //代理请求的访问日志
+	RequestIdHeader string          `yaml:"request_id_header"` //请求 ID 使用的头，默认 X-Request-ID
+
+	TrustedProxies []string `yaml:"trusted_proxies"` //可信代理的 CIDR 或 IP，如前面的 nginx，只有它们传过来的 X-Forwarded-* 才会被采用
+	PreserveHost   bool     `yaml:"preserve_host"`   //转发给实例时保留客户端请求的 Host
+	HostRewrite    string   `yaml:"host_rewrite"`    //不保留 Host 时改成这个值，默认为实例的地址
+
+	Upstream UpstreamConfig `yaml:"upstream"` //连接实例的连接池和超时
+	Retry    RetryConfig    `yaml:"retry"`    //请求实例失败时换一个实例重试
+
+	WaitQueue WaitQueueConfig `yaml:"wait_queue"` //没有可用实例时让请求排队等待
+
+	Access AccessConfig `yaml:"access"` //按客户端 IP 和 HTTP Basic 认证限制访问，转发给实例之前检查
+
+	RateLimits  []RateLimitConfig `yaml:"rate_limits"` //令牌桶限流，超过时返回 429
+	Concurrency ConcurrencyConfig `yaml:"concurrency"` //服务和每个实例同时处理的请求数上限，超过时返回 503
+
+	Rewrite RewriteConfig `yaml:"rewrite"` //转发给实例前改写请求头、路径和查询参数，或者直接重定向；修改响应头
+
+	ErrorPages  ErrorPagesConfig  `yaml:"error_pages"` //smoothserve 自己返回的错误（如 502、503、504）使用的页面模板
+	Maintenance MaintenanceConfig `yaml:"maintenance"` //维护模式，可以通过 smoothtool maintenance on|off 切换
+
+	Compression CompressionConfig `yaml:"compression"` //按客户端的 Accept-Encoding 压缩实例的响应
+
+	LongConnections LongConnectionConfig `yaml:"long_connections"` //WebSocket、SSE 等长连接在重启实例时的处理
+
+	Tls TlsConfig `yaml:"tls"` //在 port 上以 HTTPS 提供服务
+
+	DefaultServer bool `yaml:"default_server"` //端口上没有匹配的域名时由这个服务处理，每个端口最多一个
+
+	Routes []RouteConfig `yaml:"routes"` //只处理域名下满足这些规则的请求，同一个域名可以按路径分给不同的服务，不配置时处理所有请求
+
+	ConfigFile string `yaml:"-"` //这个服务的配置文件路径，重启时用于重新读取配置
+}
+
+// ResourceLimits 实例的资源限制，文件数通过 setrlimit 设置，其它的在支持 cgroup v2 时通过 cgroup 设置
+type ResourceLimits struct {
+	MaxOpenFiles uint64  `yaml:"max_open_files"` //RLIMIT_NOFILE
+	MaxMemory    string  `yaml:"max_memory"`     //如 512M、2G，cgroup memory.max；没有 cgroup v2 时使用 RLIMIT_AS，限制的是虚拟地址空间，不是同一种限制
+	CpuWeight    int     `yaml:"cpu_weight"`     //cgroup cpu.weight，1-10000，默认100
+	CpuQuota     float64 `yaml:"cpu_quota"`      //最多使用几个cpu核心，如 1.5，cgroup cpu.max
+	MaxPids      int     `yaml:"max_pids"`       //cgroup pids.max，实例和它的子进程最多能有多少个进程/线程
+}
+
+// IsEmpty 是否没有配置任何限制
+func (limits ResourceLimits) IsEmpty() bool {
+	return limits == ResourceLimits{}
+}
+
+// AccessLogConfig 访问日志，写到单独的文件里，按大小切割
+type AccessLogConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	FilePath     string   `yaml:"file_path"`     //相对路径以 smoothserve 的工作目录为根
+	Format       string   `yaml:"format"`        //combined 或 json，默认 combined
+	MaxSize      int      `yaml:"max_size"`      //单个文件最大多少MB，默认100
+	MaxBackups   int      `yaml:"max_backups"`   //保留几个切割后的文件
+	MaxAge       int      `yaml:"max_age"`       //切割后的文件保留几天
+	Compress     bool     `yaml:"compress"`      //是否压缩切割后的文件
+	SampleRate   float64  `yaml:"sample_rate"`   //0-1，只记录这个比例的请求，5xx 总是记录，默认1
+	ExcludePaths []string `yaml:"exclude_paths"` //这些路径前缀的请求不记录，如 /health，按路径段匹配
+}
+
+// UpstreamConfig 连接实例的 Transport 设置，时间单位都是秒
+type UpstreamConfig struct {
+	DisableKeepAlive        bool `yaml:"disable_keep_alive"`          //不复用到实例的连接
+	MaxIdleConnsPerInstance int  `yaml:"max_idle_conns_per_instance"` //每个实例保留的空闲连接数，默认32
+	IdleConnTimeout         int  `yaml:"idle_conn_timeout"`           //空闲连接多久后关闭，默认90
+	DialTimeout             int  `yaml:"dial_timeout"`                //连接实例的超时，默认5
+	ResponseHeaderTimeout   int  `yaml:"response_header_timeout"`     //等待实例响应头的超时，默认不限制
+	BufferSize              int  `yaml:"buffer_size"`                 //复制响应体的缓冲区字节数，默认32K
+
+	Protocol           string `yaml:"protocol"`             //连接实例的协议：http1（默认）、h2c（明文 HTTP/2，gRPC 服务使用）、h2（HTTP/2 over TLS）
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` //h2 时不校验实例的证书，实例使用自签名证书时开启
+	TlsServerName      string `yaml:"tls_server_name"`      //h2 时校验实例证书使用的名字，默认使用 server_ip
+}
+
+const (
+	ProtocolHttp1 = "http1"
+	ProtocolH2c   = "h2c"
+	ProtocolH2    = "h2"
+)
+
+// RetryConfig 请求实例失败时的重试
+type RetryConfig struct {
+	Attempts    int   `yaml:"attempts"`      //最多换几次实例，0 为不重试
+	OnStatus    []int `yaml:"on_status"`     //幂等的请求收到这些状态码时也重试，如 [502, 503]
+	MaxBodySize int64 `yaml:"max_body_size"` //请求体不超过这个字节数时缓存下来用于重试，默认64K
+}
+
+// LongConnectionConfig 滚动重启时，先等实例上的长连接自己结束，到期后再关闭它们并停止实例
+type LongConnectionConfig struct {
+	DrainTimeout int  `yaml:"drain_timeout"` //停止实例前最多等待长连接结束的秒数，0 为不等待
+	CloseFrame   bool `yaml:"close_frame"`   //关闭 WebSocket 连接前给客户端发送 1001 Going Away 关闭帧
+}
+
+// RewriteConfig 服务的改写规则，在路由规则之后、转发给实例之前执行
+type RewriteConfig struct {
+	RequestHeaders  HeaderRules   `yaml:"request_headers"`  //转发给实例的请求头，在 X-Forwarded-* 之后修改，可以覆盖它们
+	ResponseHeaders HeaderRules   `yaml:"response_headers"` //实例和静态文件的响应头
+	Rules           []RewriteRule `yaml:"rules"`            //按顺序执行的路径、查询参数改写和重定向
+}
+
+// HeaderRules 先删除，再设置，最后追加
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+}
+
+// RewriteRule 路径匹配时执行的改写，模板里可以用 $1、${name} 引用 match 的分组
+type RewriteRule struct {
+	Match       string            `yaml:"match"`        //路径正则，为空时匹配所有路径
+	Path        string            `yaml:"path"`         //改写后的路径，如 /new/$1
+	QuerySet    map[string]string `yaml:"query_set"`    //设置查询参数
+	QueryAdd    map[string]string `yaml:"query_add"`    //追加查询参数
+	QueryRemove []string          `yaml:"query_remove"` //删除查询参数，如 utm_source
+	Redirect    int               `yaml:"redirect"`     //301、302、307 或 308，设置后直接返回重定向，不转发给实例
+	Location    string            `yaml:"location"`     //重定向的地址，如 https://example.com/$1，默认为改写后的路径和查询参数
+	Last        bool              `yaml:"last"`         //匹配后不再执行后面的规则
+	Regex       *regexp.Regexp    `yaml:"-"`            //match 编译后的正则，检查配置时设置
+}
+
+// ErrorPagesConfig 状态码 -> 模板文件，相对路径以可执行文件所在目录为根，文件修改后自动生效
+// 模板里可以使用 {{.Status}} {{.StatusText}} {{.Message}} {{.RequestId}} {{.Service}} {{.Host}} {{.Path}}
+type ErrorPagesConfig struct {
+	Html map[int]string `yaml:"html"` //html/template 模板
+	Json map[int]string `yaml:"json"` //客户端 Accept 是 application/json 时使用，text/template 模板，用 {{json .Message}} 输出转义后的字符串
+}
+
+// MaintenanceConfig 维护模式下返回 503 维护页，实例继续运行
+type MaintenanceConfig struct {
+	Enabled    bool     `yaml:"enabled"`     //smoothserve 启动时就处于维护模式
+	Html       string   `yaml:"html"`        //维护页模板，默认使用 error_pages 里 503 的模板
+	Json       string   `yaml:"json"`        //JSON 维护页模板，默认使用 error_pages 里 503 的模板
+	Allow      []string `yaml:"allow"`       //维护时仍然可以访问实例的 IP 或 CIDR，按 trusted_proxies 得到的真实客户端 IP 判断
+	RetryAfter int      `yaml:"retry_after"` //维护页的 Retry-After 秒数，0 为不发送
+}
+
+// CompressionConfig 压缩实例的响应，已经压缩的响应、SSE 和 Range 响应不压缩
+type CompressionConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Encodings    []string `yaml:"encodings"`     //按优先顺序使用客户端支持的编码，br 或 gzip，默认 [br, gzip]
+	ContentTypes []string `yaml:"content_types"` //压缩的响应类型，text/* 匹配所有 text 类型，默认为文本、JSON、JavaScript、XML 和 SVG
+	MinSize      int      `yaml:"min_size"`      //Content-Length 小于这个字节数时不压缩，默认1024
+}
+
+// TlsConfig 服务的 HTTPS 配置，多个服务可以共用一个端口（如443），按 SNI 选择证书
+type TlsConfig struct {
+	CertFile     string   `yaml:"cert_file"`     //证书文件（含中间证书），相对路径以可执行文件所在目录为根，文件变化后自动重新加载
+	KeyFile      string   `yaml:"key_file"`      //私钥文件
+	MinVersion   string   `yaml:"min_version"`   //最低 TLS 版本：1.0、1.1、1.2（默认）、1.3
+	CipherSuites []string `yaml:"cipher_suites"` //TLS 1.2 及以下允许的加密套件，如 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256，默认使用 Go 的默认值
+	RedirectPort int      `yaml:"redirect_port"` //在这个端口上监听 HTTP，把请求重定向到 HTTPS，0 为不监听
+
+	Acme AcmeConfig `yaml:"acme"` //通过 ACME（如 Let's Encrypt）自动申请证书，不需要 cert_file 和 key_file
+}
+
+// AcmeConfig 为 server_name 里的每个域名自动申请和续期证书，通过 HTTP-01（redirect_port，需要是外部的80端口）或 TLS-ALPN-01（port，需要是外部的443端口）验证
+type AcmeConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Email        string `yaml:"email"`         //证书到期等通知的联系邮箱
+	DirectoryUrl string `yaml:"directory_url"` //ACME 服务的目录地址，默认 Let's Encrypt，测试时可以使用 Pebble 的 https://localhost:14000/dir
+	CaFile       string `yaml:"ca_file"`       //连接 ACME 服务时信任的 CA 证书，如 Pebble 的 pebble.minica.pem
+	RenewBefore  int    `yaml:"renew_before"`  //证书到期前几天续期，默认30
+}
+
+// Enabled 配置了证书或开启了 ACME 时服务使用 HTTPS
+func (tlsConfig TlsConfig) Enabled() bool {
+	return tlsConfig.CertFile != "" || tlsConfig.Acme.Enabled
+}
+
+// RouteConfig 一条路由规则，条件都满足时请求交给这个服务；path、path_prefix、path_regex 最多配置一个，都不配置时匹配所有路径
+type RouteConfig struct {
+	Path        string            `yaml:"path"`         //完全匹配的路径
+	PathPrefix  string            `yaml:"path_prefix"`  //路径前缀，按路径段匹配，/api 匹配 /api 和 /api/users，不匹配 /apis
+	PathRegex   string            `yaml:"path_regex"`   //路径正则
+	Methods     []string          `yaml:"methods"`      //允许的请求方法，为空时不限
+	Headers     map[string]string `yaml:"headers"`      //请求头必须等于这些值，值为 * 时只要求有这个头
+	Priority    int               `yaml:"priority"`     //优先级，大的先匹配；相同时完全匹配、前缀（长的优先）、正则
+	StripPrefix bool              `yaml:"strip_prefix"` //转发给实例时去掉 path_prefix，并通过 X-Forwarded-Prefix 告诉实例
+	Rewrite     string            `yaml:"rewrite"`      //转发给实例的路径：path 时替换整个路径，path_prefix 时替换前缀，path_regex 时作为替换模板，可以用 $1
+	Regex       *regexp.Regexp    `yaml:"-"`            //path_regex 编译后的正则，检查配置时设置
+
+	Access AccessConfig `yaml:"access"` //这个路由的访问限制，和服务的 access 都通过时才会处理请求
+
+	Static StaticConfig `yaml:"static"` //配置了 root 时由 smoothserve 直接返回目录里的文件，不转发给实例，改写后的路径作为文件路径
+}
+
+// StaticConfig 静态文件，支持 ETag、Last-Modified、Range 和预压缩的文件
+type StaticConfig struct {
+	Root          string             `yaml:"root"`          //文件目录，相对路径以可执行文件所在目录为根
+	Index         []string           `yaml:"index"`         //请求目录时依次尝试的文件，默认 index.html
+	SpaFallback   string             `yaml:"spa_fallback"`  //文件不存在时返回的文件（相对 root），用于单页应用的前端路由，如 /index.html
+	Precompressed bool               `yaml:"precompressed"` //客户端支持时优先返回同名的 .br、.gz 文件
+	CacheControl  []CacheControlRule `yaml:"cache_control"` //按文件名设置 Cache-Control，使用第一条匹配的规则
+}
+
+// CacheControlRule 文件名匹配时使用的 Cache-Control
+type CacheControlRule struct {
+	Match string `yaml:"match"` //通配符，如 *.html；包含 / 时匹配相对 root 的完整路径，如 /assets/*
+	Value string `yaml:"value"` //如 no-cache、public, max-age=31536000, immutable
+}
+
+// StaticOnly 所有路由都是静态文件时不需要启动实例
+func (serviceData ServiceData) StaticOnly() bool {
+	for _, route := range serviceData.Routes {
+		if route.Static.Root == "" {
+			return false
+		}
+	}
+	return len(serviceData.Routes) > 0
+}
+
+// WaitQueueConfig 没有可用实例时（如只有一个实例正在重启），请求在队列里等待实例恢复
+type WaitQueueConfig struct {
+	MaxLength int `yaml:"max_length"` //最多排队的请求数，0 为不排队，直接返回 503
+	MaxWait   int `yaml:"max_wait"`   //最多等待几秒，默认10
+}
+
+const (
+	SatisfyAll = "all"
+	SatisfyAny = "any"
+)
+
+// AccessConfig 访问控制，deny 优先；同时配置了 allow 和 basic_auth 时按 satisfy 组合
+type AccessConfig struct {
+	Allow     []string        `yaml:"allow"`      //只允许这些 IP 或 CIDR 访问（按 trusted_proxies 得到的真实客户端 IP），为空时不限
+	Deny      []string        `yaml:"deny"`       //拒绝这些 IP 或 CIDR，先于 allow 检查
+	BasicAuth BasicAuthConfig `yaml:"basic_auth"` //HTTP Basic 认证
+	Satisfy   string          `yaml:"satisfy"`    //all（默认）：IP 在 allow 里并且密码正确；any：IP 在 allow 里或者密码正确
+}
+
+// BasicAuthConfig 用 htpasswd 文件（bcrypt，如 htpasswd -B 生成）认证，文件修改后自动生效
+type BasicAuthConfig struct {
+	HtpasswdFile string `yaml:"htpasswd_file"` //相对路径以可执行文件所在目录为根
+	Realm        string `yaml:"realm"`         //浏览器登录框里显示的名字，默认为服务名
+}
+
+// Enabled 配置了任何访问限制
+func (access AccessConfig) Enabled() bool {
+	return len(access.Allow) > 0 || len(access.Deny) > 0 || access.BasicAuth.HtpasswdFile != ""
+}
+
+const (
+	RateLimitIp     = "ip"
+	RateLimitHeader = "header"
+	RateLimitRoute  = "route"
+)
+
+// RateLimitConfig 一条令牌桶限流规则，每个 key 一个桶，所有规则都有令牌时请求才会被转发
+type RateLimitConfig struct {
+	Key        string   `yaml:"key"`         //ip（默认，按 trusted_proxies 得到的真实客户端 IP）、header（按请求头的值，没有这个头时按 IP）或 route（匹配的请求共用一个桶）
+	Header     string   `yaml:"header"`      //key 为 header 时使用的请求头，如 X-Api-Key
+	PathPrefix string   `yaml:"path_prefix"` //只限制这个前缀下的请求（客户端请求的路径），为空时限制所有请求
+	Methods    []string `yaml:"methods"`     //只限制这些请求方法，为空时不限
+	Rate       float64  `yaml:"rate"`        //每秒补充的令牌数，也就是平均每秒允许的请求数
+	Burst      int      `yaml:"burst"`       //桶的容量，允许的突发请求数，默认为 rate 向上取整
+}
+
+// ConcurrencyConfig 同时处理的请求数上限，0 为不限
+type ConcurrencyConfig struct {
+	MaxRequests    int `yaml:"max_requests"`     //整个服务同时转发给实例的请求数
+	MaxPerInstance int `yaml:"max_per_instance"` //每个实例同时处理的请求数，实例满了时选择其它实例，都满了时排队（配置了 wait_queue）或返回 503
+	RetryAfter     int `yaml:"retry_after"`      //返回 503 时的 Retry-After 秒数，默认1
 }
 
 type SmoothServeConfig struct {
 	CommandPort  int
 	ProxyAddr    string
 	SubConfigDir string
+	CgroupRoot   string //smoothserve 为实例创建的 cgroup v2 子树，默认 /sys/fs/cgroup/smoothserve
+	AcmeDir      string //ACME 账号和自动申请的证书保存的目录，每个服务一个子目录，默认 /var/lib/smoothserve/acme
 	Log          log.LogConfig
 }
 
@@ -73,19 +367,14 @@ func LoadServerMap(configDir string) {
 
 	for _, file := range files {
 		// 读取配置文件
-		data, err := os.ReadFile(file)
-		if err != nil {
-			continue
-		}
-		var serviceData ServiceData
-		err = yaml.Unmarshal(data, &serviceData)
+		serviceData, err := LoadServiceData(file)
 		if err != nil {
 			log.Error("Parse serviceData config failed, skip  config file :", zap.String("file", file), zap.Error(err))
 
 			continue
 		}
 
-		if serviceData.Port == 0 || serviceData.ServerName == "" || serviceData.InstanceCount == 0 {
+		if serviceData.Port == 0 || serviceData.ServerName == "" && !serviceData.DefaultServer || serviceData.InstanceCount == 0 && !serviceData.StaticOnly() {
 
 			log.Error("serviceData config miss required attributes, skip  config file :", zap.String("file", file))
 
@@ -97,6 +386,11 @@ func LoadServerMap(configDir string) {
 			continue
 		}
 
+		if err := ValidateInstanceSettings(serviceData); err != nil {
+			log.Error("serviceData config has invalid instance settings, skip  config file :", zap.String("file", file), zap.Error(err))
+			continue
+		}
+
 		if serviceData.ServerIp == "" {
 			serviceData.ServerIp = "127.0.0.1"
 		}
@@ -104,3 +398,342 @@ func LoadServerMap(configDir string) {
 
 	}
 }
+
+// LoadServiceData 读取单个服务的配置文件
+func LoadServiceData(file string) (ServiceData, error) {
+	var serviceData ServiceData
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return serviceData, err
+	}
+	err = yaml.Unmarshal(data, &serviceData)
+	if err != nil {
+		return serviceData, err
+	}
+	serviceData.ConfigFile = file
+	return serviceData, nil
+}
+
+// ValidateInstanceSettings 检查配置的用户、组是否存在，umask 和资源限制是否合法
+// 路由和改写规则的正则编译后保存在 serviceData 的规则里，创建服务时直接使用
+func ValidateInstanceSettings(serviceData ServiceData) error {
+	if serviceData.User != "" {
+		if _, err := LookupUser(serviceData.User); err != nil {
+			return err
+		}
+	}
+	for _, name := range append([]string{serviceData.Group}, serviceData.Groups...) {
+		if name == "" {
+			continue
+		}
+		if _, err := LookupGroup(name); err != nil {
+			return err
+		}
+	}
+	if serviceData.Limits.MaxMemory != "" {
+		if _, err := ParseSize(serviceData.Limits.MaxMemory); err != nil {
+			return err
+		}
+	}
+	if serviceData.Limits.CpuWeight < 0 || serviceData.Limits.CpuWeight > 10000 {
+		return fmt.Errorf("cpu_weight %d out of range 1-10000", serviceData.Limits.CpuWeight)
+	}
+	switch serviceData.Upstream.Protocol {
+	case "", ProtocolHttp1, ProtocolH2c, ProtocolH2:
+	default:
+		return fmt.Errorf("unknown upstream protocol %q, expect http1, h2c or h2", serviceData.Upstream.Protocol)
+	}
+	if serviceData.Upstream.Protocol == ProtocolH2c && serviceData.Upstream.DisableKeepAlive {
+		return fmt.Errorf("disable_keep_alive can not be used with upstream protocol h2c")
+	}
+	if serviceData.Tls.Enabled() {
+		if serviceData.Tls.Acme.Enabled && serviceData.Tls.CertFile != "" {
+			return fmt.Errorf("tls cert_file and acme can not be used together")
+		}
+		if serviceData.Tls.CertFile != "" && serviceData.Tls.KeyFile == "" {
+			return fmt.Errorf("tls cert_file is set without key_file")
+		}
+		if _, err := ParseTlsVersion(serviceData.Tls.MinVersion); err != nil {
+			return err
+		}
+		if _, err := ParseCipherSuites(serviceData.Tls.CipherSuites); err != nil {
+			return err
+		}
+	}
+	for _, serverName := range strings.Split(serviceData.ServerName, ",") {
+		if serverName = strings.TrimSpace(serverName); serverName != "" {
+			if !strings.HasPrefix(serverName, "~") {
+				serverName, _, _ = strings.Cut(serverName, "/")
+			}
+			if _, err := ParseHostPattern(serverName); err != nil {
+				return err
+			}
+		}
+	}
+	for _, encoding := range serviceData.Compression.Encodings {
+		if encoding != "br" && encoding != "gzip" {
+			return fmt.Errorf("unknown compression encoding %q, expect br or gzip", encoding)
+		}
+	}
+	if err := validateAccess("access", serviceData.Access); err != nil {
+		return err
+	}
+	if err := validateRateLimits(serviceData.RateLimits); err != nil {
+		return err
+	}
+	if err := validateRewrites(serviceData.Rewrite.Rules); err != nil {
+		return err
+	}
+	if err := validateRoutes(serviceData.Routes); err != nil {
+		return err
+	}
+	if serviceData.Umask != "" {
+		if _, err := strconv.ParseUint(serviceData.Umask, 8, 32); err != nil {
+			return fmt.Errorf("invalid umask %q: %w", serviceData.Umask, err)
+		}
+	}
+	return nil
+}
+
+// 域名的匹配方式，也是匹配的优先顺序
+const (
+	HostExact            = iota //完全匹配，如 example.com
+	HostLeadingWildcard         //*.example.com，匹配任意层级的子域名，不匹配 example.com 本身
+	HostTrailingWildcard        //www.example.*
+	HostRegex                   //~ 开头的正则，如 ~^(www\.)?example\.(com|net)$
+)
+
+// HostPattern server_name 里的一个域名
+type HostPattern struct {
+	Kind  int
+	Value string //完全匹配的域名，或者通配符去掉 * 之后的部分，都是小写
+	Regex *regexp.Regexp
+}
+
+// ParseHostPattern 解析 server_name 里的一个域名，* 只能出现在开头（*.）或结尾（.*）
+func ParseHostPattern(name string) (HostPattern, error) {
+	if strings.HasPrefix(name, "~") {
+		regex, err := regexp.Compile(name[1:])
+		if err != nil {
+			return HostPattern{}, fmt.Errorf("invalid server_name regex %q: %w", name, err)
+		}
+		return HostPattern{Kind: HostRegex, Value: name, Regex: regex}, nil
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	pattern := HostPattern{Kind: HostExact, Value: name}
+	switch {
+	case strings.HasPrefix(name, "*."):
+		pattern = HostPattern{Kind: HostLeadingWildcard, Value: name[1:]}
+	case strings.HasSuffix(name, ".*"):
+		pattern = HostPattern{Kind: HostTrailingWildcard, Value: name[:len(name)-1]}
+	}
+	if strings.Contains(pattern.Value, "*") {
+		return HostPattern{}, fmt.Errorf("invalid server_name %q, * is only allowed as *.example.com or www.example.*", name)
+	}
+	return pattern, nil
+}
+
+// Match 域名是否匹配，host 需要是去掉端口的小写域名
+func (pattern HostPattern) Match(host string) bool {
+	switch pattern.Kind {
+	case HostLeadingWildcard:
+		return len(host) > len(pattern.Value) && strings.HasSuffix(host, pattern.Value)
+	case HostTrailingWildcard:
+		return len(host) > len(pattern.Value) && strings.HasPrefix(host, pattern.Value)
+	case HostRegex:
+		return pattern.Regex.MatchString(host)
+	}
+	return host == pattern.Value
+}
+
+// validateRoutes 检查路由规则的匹配方式和正则，编译好的正则保存在规则里
+func validateRoutes(routes []RouteConfig) error {
+	for i, route := range routes {
+		count := 0
+		for _, value := range []string{route.Path, route.PathPrefix, route.PathRegex} {
+			if value != "" {
+				count++
+			}
+		}
+		if count > 1 {
+			return fmt.Errorf("route %d: only one of path, path_prefix and path_regex can be set", i)
+		}
+		if route.PathRegex != "" {
+			regex, err := regexp.Compile(route.PathRegex)
+			if err != nil {
+				return fmt.Errorf("route %d: invalid path_regex: %w", i, err)
+			}
+			routes[i].Regex = regex
+		}
+		if route.StripPrefix && route.PathPrefix == "" {
+			return fmt.Errorf("route %d: strip_prefix needs path_prefix", i)
+		}
+		if route.Rewrite != "" && count == 0 {
+			return fmt.Errorf("route %d: rewrite needs path, path_prefix or path_regex", i)
+		}
+		for _, rule := range route.Static.CacheControl {
+			if _, err := path.Match(rule.Match, ""); err != nil {
+				return fmt.Errorf("route %d: invalid cache_control match %q: %w", i, rule.Match, err)
+			}
+		}
+		if route.Static.Root == "" && (route.Static.SpaFallback != "" || len(route.Static.Index) > 0) {
+			return fmt.Errorf("route %d: static needs root", i)
+		}
+		if err := validateAccess(fmt.Sprintf("route %d: access", i), route.Access); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAccess 检查 IP 列表和 satisfy；allow 里写错的地址被忽略会让所有人都能访问，所以在这里就报错
+func validateAccess(kind string, access AccessConfig) error {
+	for _, entry := range append(append([]string{}, access.Allow...), access.Deny...) {
+		entry = strings.TrimSpace(entry)
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("%s: invalid ip or cidr %q", kind, entry)
+		}
+	}
+	switch access.Satisfy {
+	case "", SatisfyAll:
+	case SatisfyAny:
+		if len(access.Allow) == 0 || access.BasicAuth.HtpasswdFile == "" {
+			return fmt.Errorf("%s: satisfy any needs both allow and basic_auth", kind)
+		}
+	default:
+		return fmt.Errorf("%s: unknown satisfy %q, expect all or any", kind, access.Satisfy)
+	}
+	return nil
+}
+
+// validateRateLimits 检查限流规则的 key 和速率
+func validateRateLimits(limits []RateLimitConfig) error {
+	for i, limit := range limits {
+		switch limit.Key {
+		case "", RateLimitIp, RateLimitRoute:
+		case RateLimitHeader:
+			if limit.Header == "" {
+				return fmt.Errorf("rate limit %d: key header needs header", i)
+			}
+		default:
+			return fmt.Errorf("rate limit %d: unknown key %q, expect ip, header or route", i, limit.Key)
+		}
+		if limit.Rate <= 0 {
+			return fmt.Errorf("rate limit %d: rate must be greater than 0", i)
+		}
+		if limit.Burst < 0 {
+			return fmt.Errorf("rate limit %d: burst can not be negative", i)
+		}
+	}
+	return nil
+}
+
+// validateRewrites 检查改写规则的正则和重定向状态码，编译好的正则保存在规则里
+func validateRewrites(rules []RewriteRule) error {
+	for i, rule := range rules {
+		if rule.Match != "" {
+			regex, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return fmt.Errorf("rewrite rule %d: invalid match: %w", i, err)
+			}
+			rules[i].Regex = regex
+		}
+		switch rule.Redirect {
+		case 0:
+			if rule.Location != "" {
+				return fmt.Errorf("rewrite rule %d: location needs redirect", i)
+			}
+		case 301, 302, 307, 308:
+		default:
+			return fmt.Errorf("rewrite rule %d: redirect must be 301, 302, 307 or 308", i)
+		}
+	}
+	return nil
+}
+
+// LookupUser 按用户名或uid查找用户
+func LookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// LookupGroup 按组名或gid查找组
+func LookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+// ParseSize 解析 512M、2G 这样的大小，没有单位时为字节
+func ParseSize(size string) (uint64, error) {
+	input := size
+	size = strings.TrimSpace(strings.ToUpper(size))
+	size = strings.TrimSuffix(size, "B")
+	multiplier := uint64(1)
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			size = size[:len(size)-1]
+		}
+	}
+	value, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	//cgroup 的 memory.max 是 int64，乘出来不能溢出
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", input)
+	}
+	return value * multiplier, nil
+}
+
+// ParseTlsVersion 解析 1.2 这样的 TLS 版本，为空时是 TLS 1.2
+func ParseTlsVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "", "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid tls min_version %q, expect 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// ParseCipherSuites 按名字查找加密套件，不接受 Go 认为不安全的套件
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
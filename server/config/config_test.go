@@ -0,0 +1,119 @@
+package config
+
+import "testing"
+
+func TestParseHostPattern(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantKind  int
+		wantValue string
+		wantErr   bool
+		match     []string
+		noMatch   []string
+	}{
+		{name: "Example.COM.", wantKind: HostExact, wantValue: "example.com", match: []string{"example.com"}, noMatch: []string{"www.example.com"}},
+		{name: "*.example.com", wantKind: HostLeadingWildcard, wantValue: ".example.com", match: []string{"www.example.com", "a.b.example.com"}, noMatch: []string{"example.com", "badexample.com"}},
+		{name: "www.example.*", wantKind: HostTrailingWildcard, wantValue: "www.example.", match: []string{"www.example.com", "www.example.co.uk"}, noMatch: []string{"www.example", "example.com"}},
+		{name: `~^(www\.)?example\.(com|net)$`, wantKind: HostRegex, wantValue: `~^(www\.)?example\.(com|net)$`, match: []string{"example.net", "www.example.com"}, noMatch: []string{"api.example.com"}},
+		{name: "www.*.com", wantErr: true},
+		{name: "*", wantErr: true},
+		{name: "~(", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pattern, err := ParseHostPattern(test.name)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseHostPattern(%q) succeeded, want an error", test.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pattern.Kind != test.wantKind || pattern.Value != test.wantValue {
+				t.Errorf("ParseHostPattern(%q) = kind %d value %q, want kind %d value %q", test.name, pattern.Kind, pattern.Value, test.wantKind, test.wantValue)
+			}
+			for _, host := range test.match {
+				if !pattern.Match(host) {
+					t.Errorf("%q does not match %q", test.name, host)
+				}
+			}
+			for _, host := range test.noMatch {
+				if pattern.Match(host) {
+					t.Errorf("%q matches %q", test.name, host)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		{size: "1024", want: 1024},
+		{size: "512M", want: 512 << 20},
+		{size: "512mb", want: 512 << 20},
+		{size: " 2G ", want: 2 << 30},
+		{size: "1T", want: 1 << 40},
+		{size: "64k", want: 64 << 10},
+		{size: "8388607T", want: 8388607 << 40},
+		{size: "8388608T", wantErr: true}, //2^63，超过 int64
+		{size: "18446744073709551615", wantErr: true},
+		{size: "18446744073709551616", wantErr: true},
+		{size: "-1G", wantErr: true},
+		{size: "1.5G", wantErr: true},
+		{size: "G", wantErr: true},
+		{size: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseSize(test.size)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, error %v", test.size, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestValidateResourceLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  ResourceLimits
+		wantErr bool
+	}{
+		{name: "empty", limits: ResourceLimits{}},
+		{name: "all set", limits: ResourceLimits{MaxOpenFiles: 4096, MaxMemory: "512M", CpuWeight: 100, CpuQuota: 1.5, MaxPids: 64}},
+		{name: "invalid max_memory", limits: ResourceLimits{MaxMemory: "lots"}, wantErr: true},
+		{name: "max_memory overflows", limits: ResourceLimits{MaxMemory: "9999999T"}, wantErr: true},
+		{name: "cpu_weight too large", limits: ResourceLimits{CpuWeight: 10001}, wantErr: true},
+		{name: "negative cpu_weight", limits: ResourceLimits{CpuWeight: -1}, wantErr: true},
+	}
+	for _, test := range tests {
+		err := ValidateInstanceSettings(ServiceData{Limits: test.limits})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: ValidateInstanceSettings() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream UpstreamConfig
+		wantErr  bool
+	}{
+		{name: "default", upstream: UpstreamConfig{}},
+		{name: "h2c", upstream: UpstreamConfig{Protocol: ProtocolH2c}},
+		{name: "h2", upstream: UpstreamConfig{Protocol: ProtocolH2, InsecureSkipVerify: true}},
+		{name: "unknown protocol", upstream: UpstreamConfig{Protocol: "http3"}, wantErr: true},
+		{name: "h2c always keeps connections", upstream: UpstreamConfig{Protocol: ProtocolH2c, DisableKeepAlive: true}, wantErr: true},
+	}
+	for _, test := range tests {
+		err := ValidateInstanceSettings(ServiceData{Upstream: test.upstream})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: ValidateInstanceSettings() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
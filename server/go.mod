@@ -3,8 +3,14 @@ module smoothserver
 go 1.22.5
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/spf13/viper v1.18.2
+	go.uber.org/zap v1.21.0
+	golang.org/x/crypto v0.16.0
+	golang.org/x/net v0.19.0
+	golang.org/x/sys v0.15.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -23,7 +29,6 @@ require (
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
@@ -0,0 +1,264 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 简单的 Prometheus 文本格式输出，只实现 smoothserve 用到的 counter、gauge 和 histogram
+
+// DefaultBuckets 和 Prometheus 客户端默认的延迟分桶一致，单位秒
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(builder *strings.Builder)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []metric
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, m)
+}
+
+// vec 按标签值保存一组时间序列
+type vec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	mutex      sync.Mutex
+	series     map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histogram 使用
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newVec(name, help, kind string, labelNames []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labelNames: labelNames, series: make(map[string]*series)}
+}
+
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) sortedSeries() []*series {
+	result := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].labelValues, "\xff") < strings.Join(result[j].labelValues, "\xff")
+	})
+	return result
+}
+
+func (v *vec) writeHeader(builder *strings.Builder) {
+	fmt.Fprintf(builder, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(builder, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+func (v *vec) write(builder *strings.Builder) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if len(v.series) == 0 {
+		return
+	}
+	v.writeHeader(builder)
+	for _, s := range v.sortedSeries() {
+		writeSample(builder, v.name, v.labelNames, s.labelValues, "", "", s.value)
+	}
+}
+
+// CounterVec 只增不减的计数
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labelNames)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.get(labelValues).value += value
+}
+
+// GaugeVec 可增可减的当前值
+type GaugeVec struct {
+	*vec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labelNames)}
+	register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value = value
+}
+
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value += value
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Delete 删除一个时间序列，比如实例不存在以后
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.series, strings.Join(labelValues, "\xff"))
+}
+
+// HistogramVec 分桶统计
+type HistogramVec struct {
+	*vec
+	bounds []float64
+}
+
+func NewHistogramVec(name, help string, bounds []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labelNames), bounds: bounds}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.bounds))
+	}
+	for i, bound := range h.bounds {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(builder *strings.Builder) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.series) == 0 {
+		return
+	}
+	h.writeHeader(builder)
+	for _, s := range h.sortedSeries() {
+		for i, bound := range h.bounds {
+			writeSample(builder, h.name+"_bucket", h.labelNames, s.labelValues, "le", formatFloat(bound), float64(s.buckets[i]))
+		}
+		writeSample(builder, h.name+"_bucket", h.labelNames, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(builder, h.name+"_sum", h.labelNames, s.labelValues, "", "", s.sum)
+		writeSample(builder, h.name+"_count", h.labelNames, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+func writeSample(builder *strings.Builder, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) {
+	builder.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		builder.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				builder.WriteByte(',')
+			}
+			builder.WriteString(labelName)
+			builder.WriteString(`="`)
+			builder.WriteString(escapeLabel(labelValues[i]))
+			builder.WriteByte('"')
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				builder.WriteByte(',')
+			}
+			builder.WriteString(extraName)
+			builder.WriteString(`="`)
+			builder.WriteString(extraValue)
+			builder.WriteByte('"')
+		}
+		builder.WriteByte('}')
+	}
+	builder.WriteByte(' ')
+	builder.WriteString(formatFloat(value))
+	builder.WriteByte('\n')
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Handler 输出所有指标，collect 在输出前调用，用来刷新需要现读的值（实例状态、进程资源等）
+func Handler(collect func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if collect != nil {
+			collect()
+		}
+
+		registryMutex.Lock()
+		metrics := append([]metric(nil), registry...)
+		registryMutex.Unlock()
+
+		var builder strings.Builder
+		for _, m := range metrics {
+			m.write(&builder)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(builder.String()))
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, collect func()) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler(collect).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	return w.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Test requests.", "service", "code")
+	gauge := NewGaugeVec("test_in_flight", "Test gauge.", "service")
+	histogram := NewHistogramVec("test_duration_seconds", "Test histogram.", []float64{0.1, 1}, "service")
+	NewGaugeVec("test_unused", "Never set.", "service")
+
+	counter.Inc("b", "2xx")
+	counter.Add(2, "a", "5xx")
+	counter.Inc("a", "5xx")
+	gauge.Set(5, "a")
+	gauge.Dec("a")
+	gauge.Add(0.5, "b")
+	gauge.Set(1, "gone")
+	gauge.Delete("gone")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(3, "a")
+
+	collected := false
+	output := scrape(t, func() { collected = true })
+	if !collected {
+		t.Error("collect is not called before writing")
+	}
+	want := []string{
+		"# HELP test_requests_total Test requests.\n# TYPE test_requests_total counter\n" +
+			`test_requests_total{service="a",code="5xx"} 3` + "\n" +
+			`test_requests_total{service="b",code="2xx"} 1` + "\n",
+		"# TYPE test_in_flight gauge\n" + `test_in_flight{service="a"} 4` + "\n" + `test_in_flight{service="b"} 0.5` + "\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			`test_duration_seconds_bucket{service="a",le="0.1"} 1` + "\n" +
+			`test_duration_seconds_bucket{service="a",le="1"} 2` + "\n" +
+			`test_duration_seconds_bucket{service="a",le="+Inf"} 3` + "\n" +
+			`test_duration_seconds_sum{service="a"} 3.55` + "\n" +
+			`test_duration_seconds_count{service="a"} 3` + "\n",
+	}
+	for _, part := range want {
+		if !strings.Contains(output, part) {
+			t.Errorf("output does not contain\n%s\ngot\n%s", part, output)
+		}
+	}
+	//没有数据的指标和删除的序列不输出
+	for _, missing := range []string{"test_unused", `service="gone"`} {
+		if strings.Contains(output, missing) {
+			t.Errorf("output contains %s", missing)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	gauge := NewGaugeVec("test_escape", "Escaped labels.", "path")
+	gauge.Set(1, "a\"b\\c\nd")
+	if output := scrape(t, nil); !strings.Contains(output, `test_escape{path="a\"b\\c\nd"} 1`) {
+		t.Errorf("escaped label is missing from\n%s", output)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	counter := NewCounterVec("test_label_count_total", "Wrong label count.", "service")
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values does not panic")
+		}
+	}()
+	counter.Inc("a", "b")
+}
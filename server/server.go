@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go.uber.org/zap"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"smoothserver/config"
+	"smoothserver/metrics"
 	"smoothserver/service"
 	"syscall"
 )
@@ -88,8 +90,10 @@ func restartAllService() {
 }
 
 func listenCommand() {
-
-	http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+	//命令端口使用自己的 mux，不和服务共用 http.DefaultServeMux，否则通过服务的端口也能发送命令
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(collectMetrics))
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
 
 		action := string(request.PostFormValue("action"))
 		serviceName := string(request.PostFormValue("service_name"))
@@ -145,6 +149,58 @@ func listenCommand() {
 			return
 		}
 
+		if action == "crashes" {
+			crashes := make([]service.CrashRecord, 0)
+			if serviceName != "" {
+				mService := ServicesMap[serviceName]
+				if mService == nil {
+					_, _ = writer.Write([]byte("Can't find the service:" + serviceName))
+					return
+				}
+				crashes = append(crashes, mService.Crashes()...)
+			} else {
+				for _, mService := range ServicesMap {
+					crashes = append(crashes, mService.Crashes()...)
+				}
+			}
+
+			writer.Header().Set("Content-Type", "application/json")
+			err := json.NewEncoder(writer).Encode(crashes)
+			if err != nil {
+				log.Error("encode crash records failed", zap.Error(err))
+			}
+			return
+		}
+
+		if action == "maintenance" {
+			state := request.PostFormValue("state")
+			if state != "on" && state != "off" {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte("maintenance state must be on or off"))
+				return
+			}
+			on := state == "on"
+			var services []*service.Service
+			if serviceName != "" {
+				mService := ServicesMap[serviceName]
+				if mService == nil {
+					_, _ = writer.Write([]byte("Can't find the service:" + serviceName))
+					return
+				}
+				services = append(services, mService)
+			} else {
+				for _, mService := range ServicesMap {
+					services = append(services, mService)
+				}
+			}
+			for _, mService := range services {
+				mService.SetMaintenance(on)
+				log.Info("maintenance mode changed", zap.String("service", mService.Name), zap.Bool("on", on))
+				_, _ = writer.Write([]byte(fmt.Sprintf("service %s maintenance %s. ", mService.Name, state)))
+			}
+			return
+		}
+
 		if action == "restart" {
 			if serviceName != "" {
 				mService := ServicesMap[serviceName]
@@ -175,12 +231,19 @@ func listenCommand() {
 		}
 	})
 	address := fmt.Sprintf("%s:%d", config.ConfigData.ProxyAddr, config.ConfigData.CommandPort)
-	err := http.ListenAndServe(address, nil)
+	err := http.ListenAndServe(address, mux)
 	if err != nil {
 		return
 	}
 }
 
+// collectMetrics 输出 /metrics 前刷新各服务实例的状态和进程资源
+func collectMetrics() {
+	for _, mService := range ServicesMap {
+		mService.CollectMetrics()
+	}
+}
+
 func handleSysSig() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM)
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"net"
+	"net/http"
+	"smoothserver/config"
+	"strconv"
+	"time"
+)
+
+// deniedInstance 没有通过访问控制的请求在指标里的 instance 标签
+const deniedInstance = "denied"
+
+// accessControl 编译好的访问控制，服务和每个路由各有一个，没有配置时为 nil
+type accessControl struct {
+	service    *Service
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	satisfyAny bool
+	htpasswd   *htpasswdFile //没有配置 basic_auth 时为 nil
+	realm      string
+}
+
+func (service *Service) newAccessControl(accessConfig config.AccessConfig) *accessControl {
+	if !accessConfig.Enabled() {
+		return nil
+	}
+	access := &accessControl{
+		service:    service,
+		allow:      parseNetworks(service.Name, "access allow", accessConfig.Allow),
+		deny:       parseNetworks(service.Name, "access deny", accessConfig.Deny),
+		satisfyAny: accessConfig.Satisfy == config.SatisfyAny,
+		realm:      accessConfig.BasicAuth.Realm,
+	}
+	if accessConfig.BasicAuth.HtpasswdFile != "" {
+		access.htpasswd = newHtpasswdFile(service.resolvePath(accessConfig.BasicAuth.HtpasswdFile))
+	}
+	if access.realm == "" {
+		access.realm = service.Name
+	}
+	return access
+}
+
+// wrap 路由的访问控制，通过后再交给 handler
+func (access *accessControl) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if access == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !access.reject(w, r, access.service.requestId(r)) {
+			handler(w, r)
+		}
+	}
+}
+
+// reject 检查客户端 IP 和密码，不通过时返回 403 或 401，返回 true 表示请求已经处理完
+func (access *accessControl) reject(w http.ResponseWriter, r *http.Request, requestId string) bool {
+	if access == nil {
+		return false
+	}
+	ip := net.ParseIP(access.service.clientIp(r))
+	if containsIp(access.deny, ip) {
+		access.forbid(w, r, requestId, "deny")
+		return true
+	}
+	ipAllowed := len(access.allow) == 0 || containsIp(access.allow, ip)
+	if access.htpasswd == nil {
+		if !ipAllowed {
+			access.forbid(w, r, requestId, "not_allowed")
+			return true
+		}
+		return false
+	}
+	if access.satisfyAny && ipAllowed {
+		return false
+	}
+	if !access.satisfyAny && !ipAllowed {
+		access.forbid(w, r, requestId, "not_allowed")
+		return true
+	}
+	return !access.authenticate(w, r, requestId)
+}
+
+// authenticate 检查 Basic 认证，失败时返回 401 让浏览器弹出登录框
+func (access *accessControl) authenticate(w http.ResponseWriter, r *http.Request, requestId string) bool {
+	service := access.service
+	username, password, ok := r.BasicAuth()
+	if ok {
+		valid, err := access.htpasswd.verify(username, password)
+		if err != nil {
+			//文件读不了时拒绝所有人，不能因为配置出错就放开
+			log.Error("read htpasswd file failed, deny the request", zap.String("service", service.Name), zap.String("path", access.htpasswd.path), zap.Error(err))
+		}
+		if valid {
+			return true
+		}
+		log.Info("basic auth failed", zap.String("service", service.Name), zap.String("user", username),
+			zap.String("client_ip", service.clientIp(r)), zap.String("request_id", requestId))
+	}
+
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+	recorder.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(access.realm)+", charset=\"UTF-8\"")
+	service.writeError(recorder, r, http.StatusUnauthorized, "Unauthorized", requestId)
+	access.record(r, recorder, start, requestId, "unauthorized")
+	return false
+}
+
+func (access *accessControl) forbid(w http.ResponseWriter, r *http.Request, requestId string, reason string) {
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+	access.service.writeError(recorder, r, http.StatusForbidden, "Forbidden", requestId)
+	access.record(r, recorder, start, requestId, reason)
+}
+
+// record 统计被拒绝的原因并记录访问日志
+func (access *accessControl) record(r *http.Request, recorder *responseRecorder, start time.Time, requestId string, reason string) {
+	service := access.service
+	accessDenied.Inc(service.Name, reason)
+	requestsTotal.Inc(service.Name, deniedInstance, statusClass(recorder.Status()))
+	service.accessLog.Log(service.newAccessEntry(r, recorder, start, requestId))
+}
+
+func containsIp(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
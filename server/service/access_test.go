@@ -0,0 +1,78 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"smoothserver/config"
+	"testing"
+)
+
+func TestAccessReject(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, htpasswd, map[string]string{"alice": "secret"})
+
+	office := []string{"192.168.0.0/16"}
+	tests := []struct {
+		name       string
+		access     config.AccessConfig
+		clientIp   string
+		password   string //为空时不带 Authorization
+		wantStatus int    //0 表示请求通过
+	}{
+		{name: "deny", access: config.AccessConfig{Deny: []string{"203.0.113.0/24"}}, clientIp: "203.0.113.9", wantStatus: http.StatusForbidden},
+		{name: "not denied", access: config.AccessConfig{Deny: []string{"203.0.113.0/24"}}, clientIp: "198.51.100.1"},
+		{name: "allow", access: config.AccessConfig{Allow: office}, clientIp: "192.168.1.5"},
+		{name: "not allowed", access: config.AccessConfig{Allow: office}, clientIp: "198.51.100.1", wantStatus: http.StatusForbidden},
+		{name: "deny before allow", access: config.AccessConfig{Allow: office, Deny: []string{"192.168.1.5"}}, clientIp: "192.168.1.5", wantStatus: http.StatusForbidden},
+		{name: "auth without password", access: config.AccessConfig{BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}}, clientIp: "198.51.100.1", wantStatus: http.StatusUnauthorized},
+		{name: "auth wrong password", access: config.AccessConfig{BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}}, clientIp: "198.51.100.1", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "auth", access: config.AccessConfig{BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}}, clientIp: "198.51.100.1", password: "secret"},
+		{name: "all: allowed ip still needs password", access: config.AccessConfig{Allow: office, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}}, clientIp: "192.168.1.5", wantStatus: http.StatusUnauthorized},
+		{name: "all: password from other ip", access: config.AccessConfig{Allow: office, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}}, clientIp: "198.51.100.1", password: "secret", wantStatus: http.StatusForbidden},
+		{name: "all: both", access: config.AccessConfig{Allow: office, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}}, clientIp: "192.168.1.5", password: "secret"},
+		{name: "any: allowed ip", access: config.AccessConfig{Allow: office, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}, Satisfy: config.SatisfyAny}, clientIp: "192.168.1.5"},
+		{name: "any: password", access: config.AccessConfig{Allow: office, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}, Satisfy: config.SatisfyAny}, clientIp: "198.51.100.1", password: "secret"},
+		{name: "any: neither", access: config.AccessConfig{Allow: office, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}, Satisfy: config.SatisfyAny}, clientIp: "198.51.100.1", wantStatus: http.StatusUnauthorized},
+		{name: "any: deny still wins", access: config.AccessConfig{Deny: []string{"192.168.1.5"}, BasicAuth: config.BasicAuthConfig{HtpasswdFile: htpasswd}, Satisfy: config.SatisfyAny}, clientIp: "192.168.1.5", password: "secret", wantStatus: http.StatusForbidden},
+		{name: "unreadable htpasswd denies everyone", access: config.AccessConfig{BasicAuth: config.BasicAuthConfig{HtpasswdFile: filepath.Join(dir, "missing")}}, clientIp: "198.51.100.1", password: "secret", wantStatus: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", trustedProxies: parseTrustedProxies("test", []string{"127.0.0.1"})}
+			access := service.newAccessControl(test.access)
+			r := httptest.NewRequest("GET", "/admin", nil)
+			r.RemoteAddr = "127.0.0.1:5000"
+			r.Header.Set("X-Forwarded-For", test.clientIp)
+			if test.password != "" {
+				r.SetBasicAuth("alice", test.password)
+			}
+			w := httptest.NewRecorder()
+			rejected := access.reject(w, r, "request-id")
+			if rejected != (test.wantStatus != 0) {
+				t.Fatalf("reject() = %v, want %v", rejected, test.wantStatus != 0)
+			}
+			if rejected && w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="test", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAccessDisabled(t *testing.T) {
+	service := &Service{Name: "test"}
+	access := service.newAccessControl(config.AccessConfig{})
+	if access != nil {
+		t.Fatal("access control without rules is not nil")
+	}
+	called := false
+	handler := access.wrap(func(w http.ResponseWriter, r *http.Request) { called = true })
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Error("handler is not called without access rules")
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"math/rand"
+	"net/http"
+	"smoothserver/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessEntry 一条访问日志
+type accessEntry struct {
+	Time         time.Time `json:"time"`
+	RequestId    string    `json:"request_id"`
+	ClientIp     string    `json:"client_ip"`
+	Host         string    `json:"host"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Protocol     string    `json:"protocol"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	Duration     float64   `json:"duration"` //秒
+	Referer      string    `json:"referer"`
+	UserAgent    string    `json:"user_agent"`
+	UpstreamPort int       `json:"upstream_port,omitempty"`
+	UpstreamPid  string    `json:"upstream_pid,omitempty"`
+	Retries      int       `json:"retries"`
+}
+
+// accessLogger 一个服务的访问日志，未开启时为 nil
+type accessLogger struct {
+	config config.AccessLogConfig
+	mutex  sync.Mutex
+	writer io.WriteCloser
+}
+
+func newAccessLogger(accessLogConfig config.AccessLogConfig) *accessLogger {
+	if !accessLogConfig.Enabled || accessLogConfig.FilePath == "" {
+		return nil
+	}
+	if accessLogConfig.MaxSize <= 0 {
+		accessLogConfig.MaxSize = 100
+	}
+	return &accessLogger{
+		config: accessLogConfig,
+		writer: &lumberjack.Logger{
+			Filename:   accessLogConfig.FilePath,
+			MaxSize:    accessLogConfig.MaxSize,
+			MaxBackups: accessLogConfig.MaxBackups,
+			MaxAge:     accessLogConfig.MaxAge,
+			Compress:   accessLogConfig.Compress,
+			LocalTime:  true,
+		},
+	}
+}
+
+// shouldLog 按路径排除和采样率决定是否记录，5xx 总是记录
+// 路径前缀和路由一样按路径段匹配，排除 /health 不会把 /healthz 也排除掉
+func (logger *accessLogger) shouldLog(path string, status int) bool {
+	path, _, _ = strings.Cut(path, "?")
+	for _, prefix := range logger.config.ExcludePaths {
+		if hasPathPrefix(path, prefix) {
+			return false
+		}
+	}
+	if status >= 500 {
+		return true
+	}
+	rate := logger.config.SampleRate
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+func (logger *accessLogger) Log(entry accessEntry) {
+	if logger == nil || !logger.shouldLog(entry.Path, entry.Status) {
+		return
+	}
+
+	var line []byte
+	if logger.config.Format == "json" {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Error("encode access log failed", zap.Error(err))
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		line = []byte(formatCombined(entry))
+	}
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if _, err := logger.writer.Write(line); err != nil {
+		log.Error("write access log failed", zap.String("file", logger.config.FilePath), zap.Error(err))
+	}
+}
+
+// formatCombined nginx/apache 的 combined 格式，后面追加 host、耗时和上游实例
+func formatCombined(entry accessEntry) string {
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = fmt.Sprintf("%d", entry.Bytes)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s %q %q host=%q rt=%.3f upstream_port=%d upstream_pid=%s retries=%d request_id=%s\n",
+		entry.ClientIp,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Protocol,
+		entry.Status, bytes,
+		dashIfEmpty(entry.Referer), dashIfEmpty(entry.UserAgent),
+		entry.Host, entry.Duration, entry.UpstreamPort, dashIfEmpty(entry.UpstreamPid), entry.Retries, dashIfEmpty(entry.RequestId))
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// newAccessEntry 根据请求和响应生成访问日志
+func (service *Service) newAccessEntry(r *http.Request, recorder *responseRecorder, start time.Time, requestId string) accessEntry {
+	//路由规则改写过路径时记录客户端请求的原始路径
+	path := r.RequestURI
+	if path == "" {
+		path = r.URL.RequestURI()
+	}
+	return accessEntry{
+		Time:      start,
+		RequestId: requestId,
+		ClientIp:  service.clientIp(r),
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      path,
+		Protocol:  r.Proto,
+		Status:    recorder.Status(),
+		Bytes:     recorder.bytes,
+		Duration:  time.Since(start).Seconds(),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+}
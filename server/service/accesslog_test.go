@@ -0,0 +1,100 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatCombined(t *testing.T) {
+	entry := accessEntry{
+		Time:         time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("", 8*3600)),
+		RequestId:    "req-1",
+		ClientIp:     "198.51.100.1",
+		Host:         "example.com",
+		Method:       "GET",
+		Path:         "/users?id=1",
+		Protocol:     "HTTP/1.1",
+		Status:       200,
+		Bytes:        512,
+		Duration:     0.0125,
+		UserAgent:    `curl/8.0 "quoted"`,
+		UpstreamPort: 8001,
+		UpstreamPid:  "4242",
+		Retries:      1,
+	}
+	want := `198.51.100.1 - - [05/Mar/2024:14:07:09 +0800] "GET /users?id=1 HTTP/1.1" 200 512 "-" "curl/8.0 \"quoted\"" host="example.com" rt=0.013 upstream_port=8001 upstream_pid=4242 retries=1 request_id=req-1` + "\n"
+	if got := formatCombined(entry); got != want {
+		t.Errorf("formatCombined() =\n%s\nwant\n%s", got, want)
+	}
+
+	//没有转发给实例的请求（静态文件、被限流）
+	got := formatCombined(accessEntry{Time: entry.Time, Method: "GET", Path: "/", Protocol: "HTTP/2.0", Status: 304})
+	if !strings.Contains(got, `" 304 - "-" "-"`) || !strings.Contains(got, "upstream_pid=- retries=0 request_id=-") {
+		t.Errorf("formatCombined() without upstream = %s", got)
+	}
+}
+
+func TestAccessLogShouldLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.AccessLogConfig
+		path   string
+		status int
+		want   bool
+	}{
+		{name: "default", path: "/", status: 200, want: true},
+		{name: "excluded", config: config.AccessLogConfig{ExcludePaths: []string{"/health"}}, path: "/health?full=1", status: 200, want: false},
+		{name: "excluded by segment", config: config.AccessLogConfig{ExcludePaths: []string{"/health"}}, path: "/healthz", status: 200, want: true},
+		{name: "excluded even on error", config: config.AccessLogConfig{ExcludePaths: []string{"/health"}}, path: "/health", status: 503, want: false},
+		{name: "sampled out", config: config.AccessLogConfig{SampleRate: 0.0000001}, path: "/", status: 200, want: false},
+		{name: "errors are always logged", config: config.AccessLogConfig{SampleRate: 0.0000001}, path: "/", status: 500, want: true},
+		{name: "rate 1 logs everything", config: config.AccessLogConfig{SampleRate: 1}, path: "/", status: 200, want: true},
+	}
+	for _, test := range tests {
+		logger := &accessLogger{config: test.config}
+		if got := logger.shouldLog(test.path, test.status); got != test.want {
+			t.Errorf("%s: shouldLog(%s, %d) = %v, want %v", test.name, test.path, test.status, got, test.want)
+		}
+	}
+}
+
+func TestAccessLogJson(t *testing.T) {
+	if newAccessLogger(config.AccessLogConfig{FilePath: "access.log"}) != nil {
+		t.Error("disabled access log is not nil")
+	}
+	var disabled *accessLogger
+	disabled.Log(accessEntry{}) //没有开启时什么都不做
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger := newAccessLogger(config.AccessLogConfig{Enabled: true, FilePath: path, Format: "json"})
+	defer logger.writer.Close()
+
+	service := &Service{Name: "test"}
+	r := httptest.NewRequest("POST", "/api/orders?x=1", nil)
+	r.RemoteAddr = "198.51.100.7:5000"
+	r.Header.Set("User-Agent", "test-agent")
+	r.URL.Path = "/orders" //路由改写后的路径，日志里记录客户端请求的路径
+	recorder := newResponseRecorder(httptest.NewRecorder())
+	recorder.WriteHeader(201)
+	_, _ = recorder.Write([]byte("created"))
+	logger.Log(service.newAccessEntry(r, recorder, time.Now(), "req-9"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry accessEntry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("log line %q is not json: %v", data, err)
+	}
+	if entry.Path != "/api/orders?x=1" || entry.Method != "POST" || entry.Status != 201 || entry.Bytes != 7 ||
+		entry.ClientIp != "198.51.100.7" || entry.UserAgent != "test-agent" || entry.RequestId != "req-9" {
+		t.Errorf("entry = %+v", entry)
+	}
+}
@@ -0,0 +1,445 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"golang.org/x/crypto/acme"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"smoothserver/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAcmeDir         = "/var/lib/smoothserve/acme"
+	defaultAcmeRenewBefore = 30 //天
+	acmeCheckInterval      = 12 * time.Hour
+	acmeRetryInterval      = time.Hour
+	acmeChallengePath      = "/.well-known/acme-challenge/"
+)
+
+// acmeManager 通过 ACME 为服务的域名申请证书，保存在磁盘上，到期前续期并替换正在使用的证书
+// 没有用 autocert：这里启动后马上申请，证书存成其它程序也能读的 .crt 和 .key，HTTP-01 走 redirect_port
+type acmeManager struct {
+	service     string
+	client      *acme.Client
+	dir         string
+	names       []string
+	email       string
+	renewBefore time.Duration
+	useHttp01   bool //配置了 redirect_port 时才能通过 HTTP-01 验证
+
+	// registerMutex 只保护 registered，注册账号要请求 ACME 服务，不能占用握手时读证书用的 mutex
+	registerMutex sync.Mutex
+	registered    bool
+
+	mutex        sync.RWMutex
+	certificates map[string]*tls.Certificate //域名 -> 正在使用的证书
+	tokens       map[string]string           //HTTP-01 验证的 token -> key authorization
+	alpnCerts    map[string]*tls.Certificate //TLS-ALPN-01 验证握手时使用的临时证书
+}
+
+// newAcmeManager 账号和证书保存在 AcmeDir/<服务名> 下，已经申请过的证书直接从磁盘读取
+func (service *Service) newAcmeManager() (*acmeManager, error) {
+	acmeConfig := service.Data.Tls.Acme
+
+	dir := config.ConfigData.AcmeDir
+	if dir == "" {
+		dir = defaultAcmeDir
+	}
+	dir = filepath.Join(dir, service.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	accountKey, err := loadOrCreateKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("load acme account key: %w", err)
+	}
+
+	client := &acme.Client{Key: accountKey, DirectoryURL: acmeConfig.DirectoryUrl, UserAgent: "smoothserve"}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if acmeConfig.CaFile != "" {
+		data, err := os.ReadFile(acmeConfig.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("read acme ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in acme ca_file %s", acmeConfig.CaFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	renewBefore := acmeConfig.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = defaultAcmeRenewBefore
+	}
+	manager := &acmeManager{
+		service:      service.Name,
+		client:       client,
+		dir:          dir,
+		email:        acmeConfig.Email,
+		renewBefore:  time.Duration(renewBefore) * 24 * time.Hour,
+		useHttp01:    service.Data.Tls.RedirectPort > 0,
+		certificates: make(map[string]*tls.Certificate),
+		tokens:       make(map[string]string),
+		alpnCerts:    make(map[string]*tls.Certificate),
+	}
+
+	// 通配符域名需要 DNS-01 验证，不支持；正则没有确定的域名
+	for _, serverName := range service.serverNames() {
+		name, _ := splitServerName(serverName)
+		if strings.Contains(name, "*") || strings.HasPrefix(name, "~") {
+			log.Error("acme can not issue certificates for wildcard or regex names, skip it", zap.String("service", service.Name), zap.String("name", name))
+			continue
+		}
+		name = strings.ToLower(name)
+		manager.names = append(manager.names, name)
+		if certificate, err := manager.loadCertificate(name); err == nil {
+			manager.certificates[name] = certificate
+		}
+	}
+	return manager, nil
+}
+
+// run 申请还没有的证书，之后定期检查并续期快到期的证书
+func (manager *acmeManager) run() {
+	// 等监听开始，ACME 服务要连过来验证
+	time.Sleep(time.Second)
+	for {
+		interval := acmeCheckInterval
+		for _, name := range manager.names {
+			if !manager.needsRenewal(name) {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			err := manager.obtain(ctx, name)
+			cancel()
+			if err != nil {
+				log.Error("obtain acme certificate failed", zap.String("service", manager.service), zap.String("name", name), zap.Error(err))
+				interval = acmeRetryInterval
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (manager *acmeManager) needsRenewal(name string) bool {
+	manager.mutex.RLock()
+	certificate := manager.certificates[name]
+	manager.mutex.RUnlock()
+	return certificate == nil || time.Until(certificate.Leaf.NotAfter) < manager.renewBefore
+}
+
+// obtain 为一个域名申请证书，成功后保存到磁盘并马上替换正在使用的证书
+func (manager *acmeManager) obtain(ctx context.Context, name string) error {
+	if err := manager.register(ctx); err != nil {
+		return err
+	}
+	order, err := manager.authorizeOrder(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return err
+	}
+	der, err := manager.finalize(ctx, order, csr)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return err
+	}
+
+	certificate := &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}
+	if err := manager.saveCertificate(name, certificate); err != nil {
+		log.Error("save acme certificate failed", zap.String("service", manager.service), zap.String("name", name), zap.Error(err))
+	}
+	manager.mutex.Lock()
+	manager.certificates[name] = certificate
+	manager.mutex.Unlock()
+	log.Info("acme certificate obtained", zap.String("service", manager.service), zap.String("name", name), zap.Time("not_after", leaf.NotAfter))
+	return nil
+}
+
+// register 注册 ACME 账号，成功一次后不再注册；失败时下次申请证书再试
+func (manager *acmeManager) register(ctx context.Context) error {
+	manager.registerMutex.Lock()
+	defer manager.registerMutex.Unlock()
+	if manager.registered {
+		return nil
+	}
+	account := &acme.Account{}
+	if manager.email != "" {
+		account.Contact = []string{"mailto:" + manager.email}
+	}
+	_, err := manager.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("register acme account: %w", err)
+	}
+	manager.registered = true
+	return nil
+}
+
+// challengeTypes 先尝试 TLS-ALPN-01，配置了 redirect_port 时再尝试 HTTP-01
+func (manager *acmeManager) challengeTypes() []string {
+	types := []string{"tls-alpn-01"}
+	if manager.useHttp01 {
+		types = append(types, "http-01")
+	}
+	return types
+}
+
+// authorizeOrder 创建订单并完成域名验证，一种验证方式失败时用新的订单尝试下一种
+func (manager *acmeManager) authorizeOrder(ctx context.Context, name string) (*acme.Order, error) {
+	var lastErr error
+	for _, challengeType := range manager.challengeTypes() {
+		order, err := manager.client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+		if err != nil {
+			return nil, err
+		}
+		if err = manager.authorize(ctx, order, name, challengeType); err != nil {
+			lastErr = fmt.Errorf("%s: %w", challengeType, err)
+			continue
+		}
+		ready, err := manager.client.WaitOrder(ctx, order.URI)
+		if err != nil {
+			return nil, err
+		}
+		//只有创建订单的响应带有订单地址
+		ready.URI = order.URI
+		return ready, nil
+	}
+	return nil, lastErr
+}
+
+func (manager *acmeManager) authorize(ctx context.Context, order *acme.Order, name string, challengeType string) error {
+	for _, authzUrl := range order.AuthzURLs {
+		authz, err := manager.client.GetAuthorization(ctx, authzUrl)
+		if err != nil {
+			return err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("challenge not offered by the acme server")
+		}
+
+		cleanup, err := manager.prepareChallenge(challenge, name)
+		if err != nil {
+			return err
+		}
+		if _, err = manager.client.Accept(ctx, challenge); err == nil {
+			_, err = manager.client.WaitAuthorization(ctx, authz.URI)
+		}
+		cleanup()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareChallenge 准备好验证请求的响应，返回验证结束后的清理函数
+func (manager *acmeManager) prepareChallenge(challenge *acme.Challenge, name string) (func(), error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	switch challenge.Type {
+	case "tls-alpn-01":
+		certificate, err := manager.client.TLSALPN01ChallengeCert(challenge.Token, name)
+		if err != nil {
+			return nil, err
+		}
+		manager.alpnCerts[name] = &certificate
+		return func() {
+			manager.mutex.Lock()
+			delete(manager.alpnCerts, name)
+			manager.mutex.Unlock()
+		}, nil
+	case "http-01":
+		response, err := manager.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		manager.tokens[challenge.Token] = response
+		return func() {
+			manager.mutex.Lock()
+			delete(manager.tokens, challenge.Token)
+			manager.mutex.Unlock()
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported challenge type %s", challenge.Type)
+}
+
+// finalize 提交 CSR 并下载证书
+// 有的 ACME 服务（如 Pebble）异步签发，finalize 的响应里没有订单地址，这时自己等订单完成后再下载
+func (manager *acmeManager) finalize(ctx context.Context, order *acme.Order, csr []byte) ([][]byte, error) {
+	der, _, err := manager.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err == nil {
+		return der, nil
+	}
+	finished, waitErr := manager.client.WaitOrder(ctx, order.URI)
+	if waitErr != nil || finished.Status != acme.StatusValid || finished.CertURL == "" {
+		return nil, err
+	}
+	return manager.client.FetchCert(ctx, finished.CertURL, true)
+}
+
+// getCertificate 握手时使用的证书，TLS-ALPN-01 验证的握手返回验证用的临时证书
+func (manager *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		if certificate, ok := manager.alpnCerts[name]; ok {
+			return certificate, nil
+		}
+		return nil, fmt.Errorf("no tls-alpn-01 challenge in progress for %q", hello.ServerName)
+	}
+	if certificate, ok := manager.certificates[name]; ok {
+		return certificate, nil
+	}
+	//没有 SNI 或者不是服务的域名时使用第一个有证书的域名
+	for _, name := range manager.names {
+		if certificate, ok := manager.certificates[name]; ok {
+			return certificate, nil
+		}
+	}
+	return nil, fmt.Errorf("acme certificate for service %s is not ready", manager.service)
+}
+
+// httpHandler 处理 HTTP-01 验证请求，其它请求交给 fallback
+func (manager *acmeManager) httpHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		manager.mutex.RLock()
+		response, ok := manager.tokens[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+		manager.mutex.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(response))
+	})
+}
+
+func (manager *acmeManager) certificateFiles(name string) (string, string) {
+	return filepath.Join(manager.dir, name+".crt"), filepath.Join(manager.dir, name+".key")
+}
+
+func (manager *acmeManager) loadCertificate(name string) (*tls.Certificate, error) {
+	certFile, keyFile := manager.certificateFiles(name)
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// saveCertificate 证书链和私钥分开保存，先写临时文件再改名，不会读到写了一半的文件
+func (manager *acmeManager) saveCertificate(name string, certificate *tls.Certificate) error {
+	var chain []byte
+	for _, der := range certificate.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, err := encodeKey(certificate.PrivateKey)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := manager.certificateFiles(name)
+	if err := writeFileAtomic(keyFile, key, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certFile, chain, 0644)
+}
+
+// loadOrCreateKey ACME 账号的私钥，第一次使用时生成
+func loadOrCreateKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no pem block in %s", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(file, encoded, 0600)
+}
+
+func encodeKey(key crypto.PrivateKey) ([]byte, error) {
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"net"
+	"net/http"
+	"os"
+	"smoothserver/config"
+	"testing"
+	"time"
+)
+
+// 连接 Pebble 测试证书申请的完整流程，需要先启动 Pebble 和 challtestsrv（让所有域名解析到 127.0.0.1）：
+//
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 -http01 "" -tlsalpn01 "" -https01 "" -doh ""
+//	ACME_TEST_DIRECTORY_URL=https://localhost:14000/dir ACME_TEST_CA_FILE=test/certs/pebble.minica.pem go test ./service -run Acme
+//
+// 没有设置 ACME_TEST_DIRECTORY_URL 时跳过
+const (
+	pebbleTlsPort  = "5001" //Pebble 配置里的 tlsPort，TLS-ALPN-01 验证连接这个端口
+	pebbleHttpPort = "5002" //Pebble 配置里的 httpPort，HTTP-01 验证连接这个端口
+)
+
+func TestAcmeObtain(t *testing.T) {
+	directoryUrl := os.Getenv("ACME_TEST_DIRECTORY_URL")
+	if directoryUrl == "" {
+		t.Skip("ACME_TEST_DIRECTORY_URL is not set")
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		tlsAlpn    bool //监听 TLS-ALPN-01 验证的端口
+		http       bool //配置 redirect_port，监听 HTTP-01 验证的端口
+	}{
+		{name: "tls-alpn-01", serverName: "alpn.smoothserve.test", tlsAlpn: true},
+		{name: "tls-alpn-01 first", serverName: "both.smoothserve.test", tlsAlpn: true, http: true},
+		{name: "fall back to http-01", serverName: "http.smoothserve.test", http: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.ConfigData.AcmeDir = t.TempDir()
+			service := &Service{Name: "acme-test", Data: config.ServiceData{ServerName: test.serverName}}
+			service.Data.Tls.Acme = config.AcmeConfig{
+				Enabled:      true,
+				DirectoryUrl: directoryUrl,
+				CaFile:       os.Getenv("ACME_TEST_CA_FILE"),
+				RenewBefore:  1, //Pebble 可能随机使用只有6天有效期的 profile
+			}
+			if test.http {
+				service.Data.Tls.RedirectPort = 80
+			}
+			manager, err := service.newAcmeManager()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.tlsAlpn {
+				serveAcmeTest(t, pebbleTlsPort, func(listener net.Listener) error {
+					server := &http.Server{TLSConfig: &tls.Config{GetCertificate: manager.getCertificate, NextProtos: []string{acme.ALPNProto}}}
+					return server.ServeTLS(listener, "", "")
+				})
+			}
+			if test.http {
+				serveAcmeTest(t, pebbleHttpPort, func(listener net.Listener) error {
+					return http.Serve(listener, manager.httpHandler(http.NotFoundHandler()))
+				})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			if err := manager.obtain(ctx, test.serverName); err != nil {
+				t.Fatal(err)
+			}
+			if manager.needsRenewal(test.serverName) {
+				t.Error("certificate needs renewal right after it was obtained")
+			}
+			certificate, err := manager.getCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := certificate.Leaf.VerifyHostname(test.serverName); err != nil {
+				t.Error(err)
+			}
+			//保存到磁盘的证书在重启后直接使用
+			if _, err := manager.loadCertificate(test.serverName); err != nil {
+				t.Errorf("load saved certificate: %v", err)
+			}
+		})
+	}
+}
+
+// serveAcmeTest 在 Pebble 验证连接的端口上监听，测试结束时关闭
+func serveAcmeTest(t *testing.T, port string, serve func(listener net.Listener) error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(listener)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Error(err)
+		}
+	})
+}
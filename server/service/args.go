@@ -0,0 +1,61 @@
+package service
+
+import (
+	"fmt"
+	"smoothserver/config"
+	"strings"
+	"text/template"
+)
+
+const defaultArgTemplate = "-port={{.Port}}"
+
+// argData 命令行参数模板里可以使用的数据
+type argData struct {
+	Port    int
+	Index   int
+	Service string
+	Env     map[string]string
+}
+
+// buildArgs 按配置的 args 模板生成实例的命令行参数
+// 模板里可以使用 {{.Port}} {{.Index}} {{.Service}} {{.Env.NAME}} 或 {{env "NAME"}}
+func (service *Service) buildArgs(data *config.ServiceData, port int, env []string) ([]string, error) {
+	argTemplates := data.Args
+	if len(argTemplates) == 0 {
+		if data.PortEnv != "" {
+			//端口只通过环境变量传递
+			return nil, nil
+		}
+		argTemplates = []string{defaultArgTemplate}
+	}
+
+	values := argData{
+		Port:    port,
+		Index:   service.instanceIndexOf(port),
+		Service: service.Name,
+		Env:     make(map[string]string, len(env)),
+	}
+	for _, item := range env {
+		key, value, _ := strings.Cut(item, "=")
+		values.Env[key] = value
+	}
+	funcs := template.FuncMap{
+		"env": func(name string) string {
+			return values.Env[name]
+		},
+	}
+
+	args := make([]string, 0, len(argTemplates))
+	for i, text := range argTemplates {
+		tmpl, err := template.New(fmt.Sprintf("arg%d", i)).Funcs(funcs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse args[%d] %q: %w", i, text, err)
+		}
+		var builder strings.Builder
+		if err = tmpl.Execute(&builder, values); err != nil {
+			return nil, fmt.Errorf("execute args[%d] %q: %w", i, text, err)
+		}
+		args = append(args, builder.String())
+	}
+	return args, nil
+}
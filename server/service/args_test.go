@@ -0,0 +1,47 @@
+package service
+
+import (
+	"slices"
+	"smoothserver/config"
+	"testing"
+)
+
+func TestBuildArgs(t *testing.T) {
+	env := []string{"CONFIG=/etc/app.yaml", "WORKERS=4"}
+	tests := []struct {
+		name    string
+		data    config.ServiceData
+		want    []string
+		wantErr bool
+	}{
+		{name: "default port flag", want: []string{"-port=8001"}},
+		{name: "port only in env", data: config.ServiceData{PortEnv: "PORT"}, want: nil},
+		{
+			name: "templates",
+			data: config.ServiceData{Args: []string{"--listen=127.0.0.1:{{.Port}}", "--id={{.Service}}-{{.Index}}", "--config={{.Env.CONFIG}}", "--workers={{env \"WORKERS\"}}"}},
+			want: []string{"--listen=127.0.0.1:8001", "--id=test-1", "--config=/etc/app.yaml", "--workers=4"},
+		},
+		{name: "args win over port_env", data: config.ServiceData{PortEnv: "PORT", Args: []string{"serve"}}, want: []string{"serve"}},
+		{name: "missing env is empty", data: config.ServiceData{Args: []string{"--log={{.Env.LOG_DIR}}", "{{env \"LOG_LEVEL\"}}"}}, want: []string{"--log=", ""}},
+		{name: "parse error", data: config.ServiceData{Args: []string{"{{.Port"}}, wantErr: true},
+		{name: "execute error", data: config.ServiceData{Args: []string{"{{.Missing}}"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", Data: config.ServiceData{StartInstancePort: 8000}}
+			args, err := service.buildArgs(&test.data, 8001, env)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("buildArgs() = %q, want an error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(args, test.want) {
+				t.Errorf("buildArgs() = %q, want %q", args, test.want)
+			}
+		})
+	}
+}
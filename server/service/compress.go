@@ -0,0 +1,172 @@
+package service
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"mime"
+	"net/http"
+	"smoothserver/config"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultCompressMinSize = 1024
+	brotliLevel            = 4 //动态压缩时兼顾速度和压缩率
+)
+
+var defaultCompressTypes = []string{
+	"text/*", "application/json", "application/javascript", "application/xml", "application/rss+xml",
+	"application/atom+xml", "application/manifest+json", "image/svg+xml",
+}
+
+// compressEncoder gzip 和 brotli 的 Writer 都有这些方法
+type compressEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"br":   {New: func() any { return brotli.NewWriterLevel(nil, brotliLevel) }},
+	"gzip": {New: func() any { return gzip.NewWriter(nil) }},
+}
+
+// compression 服务的压缩配置，没有开启时为 nil
+type compression struct {
+	encodings    []string
+	contentTypes []string
+	minSize      int
+}
+
+func newCompression(compressionConfig config.CompressionConfig) *compression {
+	if !compressionConfig.Enabled {
+		return nil
+	}
+	c := &compression{encodings: compressionConfig.Encodings, contentTypes: compressionConfig.ContentTypes, minSize: compressionConfig.MinSize}
+	if len(c.encodings) == 0 {
+		c.encodings = []string{"br", "gzip"}
+	}
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = defaultCompressTypes
+	}
+	if c.minSize <= 0 {
+		c.minSize = defaultCompressMinSize
+	}
+	return c
+}
+
+// compressible 响应的类型在配置的列表里，text/* 匹配所有 text 类型
+func (c *compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.contentTypes {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, strings.ToLower(prefix)+"/") {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter 在写响应头时决定是否压缩，压缩后去掉 Content-Length，ETag 改为弱校验
+type compressWriter struct {
+	http.ResponseWriter
+	compression *compression
+	request     *http.Request
+	encoding    string
+	encoder     compressEncoder
+	decided     bool
+}
+
+func (c *compression) newWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	return &compressWriter{ResponseWriter: w, compression: c, request: r}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	// 1xx 不是最终的响应，101 升级连接后不再经过这里
+	if status >= 200 && !cw.decided {
+		cw.decided = true
+		cw.start(status)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) start(status int) {
+	header := cw.Header()
+	if status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified ||
+		cw.request.Method == http.MethodHead || header.Get("Content-Encoding") != "" ||
+		strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return
+	}
+	// SSE 是持续推送的流，不压缩
+	contentType := header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "text/event-stream") || !cw.compression.compressible(contentType) {
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < cw.compression.minSize {
+		return
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+	for _, encoding := range cw.compression.encodings {
+		if acceptsEncoding(cw.request, encoding) {
+			cw.encoding = encoding
+			break
+		}
+	}
+	if cw.encoding == "" {
+		return
+	}
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	cw.encoder = encoderPools[cw.encoding].Get().(compressEncoder)
+	cw.encoder.Reset(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(data)
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+// Flush 长度未知的响应 ReverseProxy 每次写入后都会 Flush，压缩的数据也要马上发出去
+func (cw *compressWriter) Flush() {
+	if cw.encoder != nil {
+		_ = cw.encoder.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close 写完压缩数据的结尾，Writer 放回池里
+func (cw *compressWriter) Close() {
+	if cw.encoder == nil {
+		return
+	}
+	_ = cw.encoder.Close()
+	cw.encoder.Reset(nil)
+	encoderPools[cw.encoding].Put(cw.encoder)
+	cw.encoder = nil
+}
+
+// Unwrap 升级连接时 http.ResponseController 通过它找到可以 Hijack 的 ResponseWriter
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
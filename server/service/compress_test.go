@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding []string
+		encoding       string
+		want           bool
+	}{
+		{nil, "gzip", false},
+		{[]string{"gzip, deflate, br"}, "br", true},
+		{[]string{"GZIP"}, "gzip", true},
+		{[]string{"deflate"}, "gzip", false},
+		{[]string{"gzip;q=0.5"}, "gzip", true},
+		{[]string{"gzip;q=0"}, "gzip", false},
+		{[]string{"gzip; q=0.0"}, "gzip", false},
+		{[]string{"*"}, "br", true},
+		{[]string{"*;q=0"}, "br", false},
+		{[]string{"*, gzip;q=0"}, "gzip", false},
+		{[]string{"br;q=0, *"}, "br", false},
+		{[]string{"*;q=0, br"}, "br", true},
+		{[]string{"deflate", "br"}, "br", true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, value := range test.acceptEncoding {
+			r.Header.Add("Accept-Encoding", value)
+		}
+		if got := acceptsEncoding(r, test.encoding); got != test.want {
+			t.Errorf("acceptsEncoding(%q, %s) = %v, want %v", test.acceptEncoding, test.encoding, got, test.want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		contentTypes []string
+		contentType  string
+		want         bool
+	}{
+		{nil, "text/html; charset=utf-8", true},
+		{nil, "application/json", true},
+		{nil, "Application/JSON", true},
+		{nil, "image/svg+xml", true},
+		{nil, "image/png", false},
+		{nil, "application/octet-stream", false},
+		{nil, "", false},
+		{nil, "text", false},
+		{[]string{"application/*"}, "application/wasm", true},
+		{[]string{"Text/*"}, "text/plain", true},
+		{[]string{"application/json"}, "text/html", false},
+	}
+	for _, test := range tests {
+		c := newCompression(config.CompressionConfig{Enabled: true, ContentTypes: test.contentTypes})
+		if got := c.compressible(test.contentType); got != test.want {
+			t.Errorf("compressible(%q) with %v = %v, want %v", test.contentType, test.contentTypes, got, test.want)
+		}
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	body := strings.Repeat("hello smoothserve ", 200)
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		status         int
+		header         map[string]string
+		wantEncoding   string
+	}{
+		{name: "br preferred", acceptEncoding: "gzip, br", wantEncoding: "br"},
+		{name: "gzip", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{name: "not accepted", acceptEncoding: "deflate"},
+		{name: "head", method: "HEAD", acceptEncoding: "gzip"},
+		{name: "no content", acceptEncoding: "gzip", status: http.StatusNoContent},
+		{name: "partial content", acceptEncoding: "gzip", status: http.StatusPartialContent},
+		{name: "already encoded", acceptEncoding: "gzip", header: map[string]string{"Content-Encoding": "zstd"}},
+		{name: "no-transform", acceptEncoding: "gzip", header: map[string]string{"Cache-Control": "public, no-transform"}},
+		{name: "event stream", acceptEncoding: "gzip", header: map[string]string{"Content-Type": "text/event-stream"}},
+		{name: "image", acceptEncoding: "gzip", header: map[string]string{"Content-Type": "image/png"}},
+		{name: "too small", acceptEncoding: "gzip", header: map[string]string{"Content-Length": "10"}},
+		{name: "unknown length", acceptEncoding: "gzip", header: map[string]string{"Content-Length": ""}, wantEncoding: "gzip"},
+	}
+	c := newCompression(config.CompressionConfig{Enabled: true})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, "/", nil)
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+			recorder := httptest.NewRecorder()
+			header := recorder.Header()
+			header.Set("Content-Type", "text/plain; charset=utf-8")
+			header.Set("Content-Length", strconv.Itoa(len(body)))
+			header.Set("ETag", `"v1"`)
+			for name, value := range test.header {
+				if value == "" {
+					header.Del(name)
+				} else {
+					header.Set(name, value)
+				}
+			}
+			status := test.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			writer := c.newWriter(recorder, r)
+			writer.WriteHeader(status)
+			if status != http.StatusNoContent && method != "HEAD" {
+				_, _ = io.WriteString(writer, body)
+			}
+			writer.Close()
+
+			//实例自己压缩过的响应保持原样
+			wantHeader := cmp.Or(test.wantEncoding, test.header["Content-Encoding"])
+			if got := recorder.Header().Get("Content-Encoding"); got != wantHeader {
+				t.Fatalf("Content-Encoding = %q, want %q", got, wantHeader)
+			}
+			if test.wantEncoding == "" {
+				return
+			}
+			if recorder.Header().Get("Content-Length") != "" {
+				t.Error("Content-Length is kept on a compressed response")
+			}
+			if got := recorder.Header().Get("ETag"); got != `W/"v1"` {
+				t.Errorf("ETag = %s, want a weak ETag", got)
+			}
+			if got := recorder.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q", got)
+			}
+			if got := decompress(t, test.wantEncoding, recorder.Body.Bytes()); got != body {
+				t.Errorf("decompressed body has %d bytes, want %d", len(got), len(body))
+			}
+		})
+	}
+}
+
+func decompress(t *testing.T, encoding string, data []byte) string {
+	var reader io.Reader = brotli.NewReader(bytes.NewReader(data))
+	if encoding == "gzip" {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gzipReader
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultCrashHistorySize = 20
+	defaultCrashLogLines    = 50
+)
+
+// CrashRecord 实例非预期退出时留下的现场信息
+type CrashRecord struct {
+	Service    string    `json:"service"`
+	Port       int       `json:"port"`
+	Pid        string    `json:"pid"`
+	ExitCode   int       `json:"exit_code"`
+	Signal     string    `json:"signal,omitempty"`
+	Reason     string    `json:"reason"`
+	OOMKilled  bool      `json:"oom_killed"`
+	StartTime  time.Time `json:"start_time"`
+	ExitTime   time.Time `json:"exit_time"`
+	Runtime    string    `json:"runtime"`
+	Checksum   string    `json:"checksum"`
+	OutputTail []string  `json:"output_tail"`
+}
+
+// outputTail 保存实例 stdout/stderr 的最后 N 行
+type outputTail struct {
+	mutex sync.Mutex
+	lines []string
+	max   int
+}
+
+func newOutputTail(max int) *outputTail {
+	if max <= 0 {
+		max = defaultCrashLogLines
+	}
+	return &outputTail{max: max}
+}
+
+func (tail *outputTail) Add(line string) {
+	tail.mutex.Lock()
+	defer tail.mutex.Unlock()
+	if len(tail.lines) >= tail.max {
+		tail.lines = tail.lines[1:]
+	}
+	tail.lines = append(tail.lines, line)
+}
+
+func (tail *outputTail) Lines() []string {
+	tail.mutex.Lock()
+	defer tail.mutex.Unlock()
+	lines := make([]string, len(tail.lines))
+	copy(lines, tail.lines)
+	return lines
+}
+
+// fileChecksum 计算可执行文件的 sha256，用于判断崩溃时运行的是哪一个版本
+func fileChecksum(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// newCrashRecord 根据进程退出状态生成崩溃记录
+func newCrashRecord(service *Service, port int, pid string, state *os.ProcessState, waitErr error, startTime time.Time, checksum string, tail *outputTail) CrashRecord {
+	exitTime := time.Now()
+	record := CrashRecord{
+		Service:    service.Name,
+		Port:       port,
+		Pid:        pid,
+		ExitCode:   -1,
+		StartTime:  startTime,
+		ExitTime:   exitTime,
+		Runtime:    exitTime.Sub(startTime).Round(time.Millisecond).String(),
+		Checksum:   checksum,
+		OutputTail: tail.Lines(),
+	}
+
+	if state != nil {
+		record.ExitCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			record.Signal = status.Signal().String()
+		}
+	}
+
+	switch {
+	case record.Signal != "":
+		record.Reason = "killed by signal " + record.Signal
+	case waitErr != nil:
+		record.Reason = waitErr.Error()
+	default:
+		record.Reason = "exited unexpectedly with code 0"
+	}
+	return record
+}
+
+// recordCrash 将崩溃记录加入有限长度的历史中
+func (service *Service) recordCrash(record CrashRecord) {
+	service.crashMutex.Lock()
+	defer service.crashMutex.Unlock()
+
+	size := service.Data.CrashHistorySize
+	if size <= 0 {
+		size = defaultCrashHistorySize
+	}
+	if len(service.crashes) >= size {
+		service.crashes = service.crashes[len(service.crashes)-size+1:]
+	}
+	service.crashes = append(service.crashes, record)
+	instanceCrashes.Inc(service.Name, strconv.Itoa(record.Port))
+}
+
+// Crashes 返回该服务的崩溃历史，最早的在前
+func (service *Service) Crashes() []CrashRecord {
+	service.crashMutex.Lock()
+	defer service.crashMutex.Unlock()
+	crashes := make([]CrashRecord, len(service.crashes))
+	copy(crashes, service.crashes)
+	return crashes
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"slices"
+	"smoothserver/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutputTail(t *testing.T) {
+	tail := newOutputTail(3)
+	for i := 1; i <= 5; i++ {
+		tail.Add("line " + strconv.Itoa(i))
+	}
+	want := []string{"line 3", "line 4", "line 5"}
+	lines := tail.Lines()
+	if !slices.Equal(lines, want) {
+		t.Fatalf("Lines() = %v, want %v", lines, want)
+	}
+	//返回的是副本，修改它不影响之后的记录
+	lines[0] = "changed"
+	if got := tail.Lines(); !slices.Equal(got, want) {
+		t.Errorf("Lines() after changing the copy = %v, want %v", got, want)
+	}
+
+	if got := newOutputTail(0).max; got != defaultCrashLogLines {
+		t.Errorf("default max = %d, want %d", got, defaultCrashLogLines)
+	}
+}
+
+func TestNewCrashRecord(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh and signals")
+	}
+	service := &Service{Name: "test"}
+	tail := newOutputTail(2)
+	tail.Add("starting")
+	tail.Add("panic: boom")
+	start := time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name       string
+		script     string
+		wantCode   int
+		wantSignal string
+		wantReason string
+	}{
+		{name: "exit code", script: "exit 3", wantCode: 3, wantReason: "exit status 3"},
+		{name: "signal", script: "kill -9 $$", wantCode: -1, wantSignal: "killed", wantReason: "killed by signal killed"},
+		{name: "clean exit", script: "exit 0", wantCode: 0, wantReason: "exited unexpectedly with code 0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", test.script)
+			err := cmd.Run()
+			record := newCrashRecord(service, 8001, "42", cmd.ProcessState, err, start, "sum", tail)
+			if record.ExitCode != test.wantCode || record.Signal != test.wantSignal || record.Reason != test.wantReason {
+				t.Errorf("record = code %d, signal %q, reason %q, want %d, %q, %q", record.ExitCode, record.Signal, record.Reason, test.wantCode, test.wantSignal, test.wantReason)
+			}
+			if record.Service != "test" || record.Port != 8001 || record.Pid != "42" || record.Checksum != "sum" {
+				t.Errorf("record = %+v", record)
+			}
+			if !slices.Equal(record.OutputTail, []string{"starting", "panic: boom"}) {
+				t.Errorf("output tail = %v", record.OutputTail)
+			}
+		})
+	}
+
+	//进程状态拿不到时退出码为 -1，原因用 Wait 返回的错误
+	record := newCrashRecord(service, 8001, "42", nil, errors.New("wait failed"), start, "", tail)
+	if record.ExitCode != -1 || record.Reason != "wait failed" {
+		t.Errorf("record without state = %d %q", record.ExitCode, record.Reason)
+	}
+}
+
+func TestRecordCrash(t *testing.T) {
+	service := &Service{Name: "test", Data: config.ServiceData{CrashHistorySize: 2}}
+	for port := 1; port <= 3; port++ {
+		service.recordCrash(CrashRecord{Port: port})
+	}
+	crashes := service.Crashes()
+	if len(crashes) != 2 || crashes[0].Port != 2 || crashes[1].Port != 3 {
+		t.Fatalf("Crashes() = %+v, want the last two records", crashes)
+	}
+	crashes[0].Port = 100
+	if service.Crashes()[0].Port != 2 {
+		t.Error("Crashes() does not return a copy")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package service
+
+import (
+	"errors"
+	"os/exec"
+	"smoothserver/config"
+)
+
+func (service *Service) setCredential(cmd *exec.Cmd, data *config.ServiceData) error {
+	if data.User != "" || data.Group != "" || len(data.Groups) != 0 {
+		return errors.New("running instances as another user is only supported on unix")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+//go:build unix
+
+package service
+
+import (
+	"fmt"
+	"os/exec"
+	"smoothserver/config"
+	"strconv"
+	"syscall"
+)
+
+// setCredential 让实例以配置的用户和组运行
+func (service *Service) setCredential(cmd *exec.Cmd, data *config.ServiceData) error {
+	credential, err := buildCredential(data)
+	if err != nil {
+		return err
+	}
+	if credential == nil {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential
+	return nil
+}
+
+// buildCredential 根据配置生成实例运行的用户和组，没有配置时返回 nil，和 smoothserve 相同
+func buildCredential(data *config.ServiceData) (*syscall.Credential, error) {
+	if data.User == "" && data.Group == "" && len(data.Groups) == 0 {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{
+		Uid: uint32(syscall.Getuid()),
+		Gid: uint32(syscall.Getgid()),
+	}
+
+	var groupIds []string
+	if data.User != "" {
+		u, err := config.LookupUser(data.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q: %w", u.Uid, err)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %q: %w", u.Gid, err)
+		}
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+
+		//没有配置附加组时使用用户所在的所有组，和 initgroups 一致
+		if len(data.Groups) == 0 {
+			groupIds, err = u.GroupIds()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if data.Group != "" {
+		gid, err := lookupGid(data.Group)
+		if err != nil {
+			return nil, err
+		}
+		credential.Gid = gid
+	}
+
+	for _, name := range data.Groups {
+		gid, err := lookupGid(name)
+		if err != nil {
+			return nil, err
+		}
+		credential.Groups = append(credential.Groups, gid)
+	}
+	for _, id := range groupIds {
+		gid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			continue
+		}
+		credential.Groups = append(credential.Groups, uint32(gid))
+	}
+
+	return credential, nil
+}
+
+func lookupGid(name string) (uint32, error) {
+	g, err := config.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gid %q: %w", g.Gid, err)
+	}
+	return uint32(gid), nil
+}
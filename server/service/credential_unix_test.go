@@ -0,0 +1,60 @@
+//go:build unix
+
+package service
+
+import (
+	"os/user"
+	"slices"
+	"smoothserver/config"
+	"strconv"
+	"testing"
+)
+
+func TestBuildCredential(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(current.Gid, 10, 32)
+	var userGroups []uint32
+	groupIds, err := current.GroupIds()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, id := range groupIds {
+		value, _ := strconv.ParseUint(id, 10, 32)
+		userGroups = append(userGroups, uint32(value))
+	}
+
+	credential, err := buildCredential(&config.ServiceData{})
+	if credential != nil || err != nil {
+		t.Errorf("buildCredential() without user = %+v, %v, want nil", credential, err)
+	}
+
+	for _, name := range []string{current.Username, current.Uid} {
+		credential, err = buildCredential(&config.ServiceData{User: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credential.Uid != uint32(uid) || credential.Gid != uint32(gid) || !slices.Equal(credential.Groups, userGroups) {
+			t.Errorf("user %s: credential = %+v, want uid %d gid %d groups %v", name, credential, uid, gid, userGroups)
+		}
+	}
+
+	//配置了附加组时只使用配置的组
+	credential, err = buildCredential(&config.ServiceData{User: current.Uid, Group: current.Gid, Groups: []string{current.Gid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.Gid != uint32(gid) || !slices.Equal(credential.Groups, []uint32{uint32(gid)}) {
+		t.Errorf("credential with groups = %+v", credential)
+	}
+
+	if _, err = buildCredential(&config.ServiceData{User: "smoothserve-no-such-user"}); err == nil {
+		t.Error("unknown user is accepted")
+	}
+	if _, err = buildCredential(&config.ServiceData{Group: "smoothserve-no-such-group"}); err == nil {
+		t.Error("unknown group is accepted")
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"smoothserver/config"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// buildEnv 按固定顺序合并实例的环境变量，后面的覆盖前面的:
+// smoothserve 自身的环境 -> env_file -> env -> secret_files -> SMOOTH_* 自动变量
+// env_file 和 secret_files 每次启动实例时都会重新读取，所以滚动重启时会生效
+func (service *Service) buildEnv(data *config.ServiceData, port int) ([]string, error) {
+	env := make(map[string]string)
+	for _, item := range os.Environ() {
+		key, value, found := strings.Cut(item, "=")
+		if found {
+			env[key] = value
+		}
+	}
+
+	if data.EnvFile != "" {
+		fileEnv, err := parseEnvFile(service.resolvePath(data.EnvFile))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileEnv {
+			env[key] = value
+		}
+	}
+
+	// env 里的 ${NAME} 只引用前面已经合并好的变量，不互相引用，保证结果与顺序无关
+	expanded := make(map[string]string, len(data.Env))
+	for key, value := range data.Env {
+		expanded[key] = os.Expand(value, func(name string) string {
+			return env[name]
+		})
+	}
+	for key, value := range expanded {
+		env[key] = value
+	}
+
+	for key, path := range data.SecretFiles {
+		data, err := os.ReadFile(service.resolvePath(path))
+		if err != nil {
+			return nil, fmt.Errorf("read secret file for %s: %w", key, err)
+		}
+		env[key] = strings.TrimRight(string(data), "\r\n")
+	}
+
+	for key, value := range service.autoEnv(data, port) {
+		env[key] = value
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, key+"="+env[key])
+	}
+	return result, nil
+}
+
+// autoEnv smoothserve 自动提供给实例的变量，不能被配置覆盖
+func (service *Service) autoEnv(data *config.ServiceData, port int) map[string]string {
+	env := map[string]string{
+		"SMOOTH_SERVICE":        service.Name,
+		"SMOOTH_PORT":           strconv.Itoa(port),
+		"SMOOTH_INSTANCE_INDEX": strconv.Itoa(service.instanceIndexOf(port)),
+	}
+	if data.PortEnv != "" {
+		env[data.PortEnv] = strconv.Itoa(port)
+	}
+	return env
+}
+
+// instanceIndexOf 实例的序号，从0开始，由端口推算
+func (service *Service) instanceIndexOf(port int) int {
+	return port - service.Data.StartInstancePort
+}
+
+// resolvePath 相对路径以可执行文件所在目录为根，和 watch_files 一致
+func (service *Service) resolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(service.Data.ExecutablePath), path)
+}
+
+// parseEnvFile 解析 .env 格式的文件，支持注释、export 前缀和引号
+func parseEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open env file: %w", err)
+	}
+	defer file.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: missing '='", path, lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: empty key", path, lineNumber)
+		}
+
+		value, err = parseEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func parseEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '"':
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", err
+		}
+		return unquoted, nil
+	case '\'':
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		return value[1:end], nil
+	}
+
+	// 没有引号时，# 后面是行尾注释
+	if index := strings.Index(value, " #"); index >= 0 {
+		value = strings.TrimSpace(value[:index])
+	}
+	return value, nil
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: ""},
+		{value: "plain", want: "plain"},
+		{value: "plain # comment", want: "plain"},
+		{value: "a#b", want: "a#b"},
+		{value: `"line\nbreak"`, want: "line\nbreak"},
+		{value: `"has # hash"`, want: "has # hash"},
+		{value: `'single $NAME'`, want: "single $NAME"},
+		{value: `"unterminated`, wantErr: true},
+		{value: `'unterminated`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseEnvValue(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseEnvValue(%q) = %q, %v, want %q, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "comments, export and quotes",
+			content: "# database\n\nexport DB_HOST=localhost\nDB_PORT = 5432 # default\nDB_PASSWORD=\"p@ss word\"\n",
+			want:    map[string]string{"DB_HOST": "localhost", "DB_PORT": "5432", "DB_PASSWORD": "p@ss word"},
+		},
+		{name: "missing equal sign", content: "A=1\nBROKEN\n", wantErr: ":2: missing '='"},
+		{name: "empty key", content: "=value\n", wantErr: ":1: empty key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			env, err := parseEnvFile(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseEnvFile() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(env) != len(test.want) {
+				t.Fatalf("parseEnvFile() = %v, want %v", env, test.want)
+			}
+			for key, value := range test.want {
+				if env[key] != value {
+					t.Errorf("%s = %q, want %q", key, env[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("FROM_FILE=file\nOVERRIDDEN=file\nSMOOTH_PORT=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "db_password"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMOOTH_TEST_HOME", "/home/app")
+
+	data := &config.ServiceData{
+		Name:              "test",
+		ExecutablePath:    filepath.Join(dir, "app"),
+		StartInstancePort: 8000,
+		EnvFile:           ".env",
+		Env:               map[string]string{"OVERRIDDEN": "env", "DATA_DIR": "${SMOOTH_TEST_HOME}/data", "FROM_OTHER": "${DATA_DIR}"},
+		SecretFiles:       map[string]string{"DB_PASSWORD": "db_password", "OVERRIDDEN": "db_password"},
+		PortEnv:           "PORT",
+	}
+	service := &Service{Name: "test", Data: *data}
+	env, err := service.buildEnv(data, 8002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, item := range env {
+		key, value, _ := strings.Cut(item, "=")
+		got[key] = value
+	}
+	want := map[string]string{
+		"SMOOTH_TEST_HOME":      "/home/app", //继承 smoothserve 的环境
+		"FROM_FILE":             "file",
+		"DATA_DIR":              "/home/app/data",
+		"FROM_OTHER":            "", //env 之间不互相引用
+		"DB_PASSWORD":           "s3cret",
+		"OVERRIDDEN":            "s3cret", //secret_files 覆盖 env 和 env_file
+		"SMOOTH_PORT":           "8002",   //自动变量不能被覆盖
+		"SMOOTH_SERVICE":        "test",
+		"SMOOTH_INSTANCE_INDEX": "2",
+		"PORT":                  "8002",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+
+	data.SecretFiles = map[string]string{"MISSING": "missing"}
+	if _, err := service.buildEnv(data, 8002); err == nil || !strings.Contains(err.Error(), "MISSING") {
+		t.Errorf("buildEnv() with a missing secret file error = %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// errorPageData 错误页模板里可以使用的变量
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestId  string
+	Service    string
+	Host       string
+	Path       string
+}
+
+// pageTemplate 错误页模板，文件修改后下次使用时重新读取，不需要重启
+type pageTemplate struct {
+	path    string
+	json    bool
+	mutex   sync.Mutex
+	modTime time.Time
+	execute func(*bytes.Buffer, errorPageData) error
+}
+
+// errorPages 服务的错误页模板，文件路径 -> 模板
+type errorPages struct {
+	mutex     sync.Mutex
+	templates map[string]*pageTemplate
+}
+
+func (pages *errorPages) get(path string, json bool) *pageTemplate {
+	pages.mutex.Lock()
+	defer pages.mutex.Unlock()
+	if pages.templates == nil {
+		pages.templates = make(map[string]*pageTemplate)
+	}
+	page, ok := pages.templates[path]
+	if !ok {
+		page = &pageTemplate{path: path, json: json}
+		pages.templates[path] = page
+	}
+	return page
+}
+
+// render 文件有变化时重新解析；读取或解析失败时返回错误，调用方使用纯文本的错误页
+func (page *pageTemplate) render(data errorPageData) ([]byte, error) {
+	page.mutex.Lock()
+	defer page.mutex.Unlock()
+	info, err := os.Stat(page.path)
+	if err != nil {
+		return nil, err
+	}
+	if page.execute == nil || !info.ModTime().Equal(page.modTime) {
+		content, err := os.ReadFile(page.path)
+		if err != nil {
+			return nil, err
+		}
+		if page.json {
+			tmpl, err := texttemplate.New("error").Funcs(texttemplate.FuncMap{"json": jsonString}).Parse(string(content))
+			if err != nil {
+				return nil, err
+			}
+			page.execute = func(buf *bytes.Buffer, data errorPageData) error { return tmpl.Execute(buf, data) }
+		} else {
+			tmpl, err := htmltemplate.New("error").Parse(string(content))
+			if err != nil {
+				return nil, err
+			}
+			page.execute = func(buf *bytes.Buffer, data errorPageData) error { return tmpl.Execute(buf, data) }
+		}
+		page.modTime = info.ModTime()
+	}
+	var buf bytes.Buffer
+	if err := page.execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonString JSON 模板里用 {{json .Message}} 输出带引号和转义的字符串
+func jsonString(value any) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// wantsJson 客户端明确要 JSON（如接口请求）时使用 JSON 模板
+func wantsJson(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// writeError 返回错误页，带上请求 ID 便于和日志对应；gRPC 请求返回对应的 grpc-status
+// 配置了错误页模板时按客户端的 Accept 使用 HTML 或 JSON 模板，否则返回纯文本
+func (service *Service) writeError(w http.ResponseWriter, r *http.Request, status int, message string, requestId string) {
+	pages := service.Data.ErrorPages
+	service.writeErrorWith(w, r, status, message, requestId, pages.Html[status], pages.Json[status])
+}
+
+func (service *Service) writeErrorWith(w http.ResponseWriter, r *http.Request, status int, message string, requestId string, htmlFile string, jsonFile string) {
+	if isGrpcRequest(r) {
+		service.writeGrpcError(w, status, message, requestId)
+		return
+	}
+	w.Header().Set(service.requestIdHeader(), requestId)
+	if service.writeErrorPage(w, r, status, message, requestId, htmlFile, jsonFile) {
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s\nRequest ID: %s", message, requestId), status)
+}
+
+func (service *Service) writeErrorPage(w http.ResponseWriter, r *http.Request, status int, message string, requestId string, htmlFile string, jsonFile string) bool {
+	file, contentType := htmlFile, "text/html; charset=utf-8"
+	if wantsJson(r) && jsonFile != "" || htmlFile == "" {
+		file, contentType = jsonFile, "application/json"
+	}
+	if file == "" {
+		return false
+	}
+
+	page := service.errorPages.get(service.resolvePath(file), contentType == "application/json")
+	body, err := page.render(errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestId:  requestId,
+		Service:    service.Name,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	})
+	if err != nil {
+		log.Error("render error page failed, use the plain text one", zap.String("service", service.Name), zap.String("file", file), zap.Error(err))
+		return false
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return true
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePage(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func errorPageService(t *testing.T) (*Service, string) {
+	t.Helper()
+	dir := t.TempDir()
+	writePage(t, filepath.Join(dir, "502.html"), "<p>{{.Status}} {{.StatusText}}: {{.Message}} ({{.RequestId}}) on {{.Service}} {{.Host}}{{.Path}}</p>")
+	writePage(t, filepath.Join(dir, "502.json"), `{"status":{{.Status}},"error":{{json .Message}},"request_id":{{json .RequestId}}}`)
+	service := &Service{Name: "test", Data: config.ServiceData{
+		ExecutablePath: filepath.Join(dir, "app"),
+		ErrorPages: config.ErrorPagesConfig{
+			Html: map[int]string{http.StatusBadGateway: "502.html", http.StatusGatewayTimeout: "broken.html"},
+			Json: map[int]string{http.StatusBadGateway: "502.json"},
+		},
+	}}
+	return service, dir
+}
+
+func writeTestError(service *Service, status int, message string, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/api/users", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	service.writeError(w, r, status, message, "req-1")
+	return w
+}
+
+func TestErrorPageTemplates(t *testing.T) {
+	service, _ := errorPageService(t)
+
+	html := writeTestError(service, http.StatusBadGateway, "<b>Bad Gateway</b>", "text/html,application/json")
+	if html.Code != http.StatusBadGateway || html.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("html = %d %s", html.Code, html.Header().Get("Content-Type"))
+	}
+	//html 模板会转义消息里的标签
+	wantHtml := "<p>502 Bad Gateway: &lt;b&gt;Bad Gateway&lt;/b&gt; (req-1) on test example.com/api/users</p>"
+	if html.Body.String() != wantHtml {
+		t.Errorf("html body = %q, want %q", html.Body.String(), wantHtml)
+	}
+	if html.Header().Get("X-Request-Id") != "req-1" {
+		t.Errorf("request id header = %q", html.Header().Get("X-Request-Id"))
+	}
+
+	page := writeTestError(service, http.StatusBadGateway, `say "hi"`, "application/json")
+	if page.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("json Content-Type = %s", page.Header().Get("Content-Type"))
+	}
+	var body struct {
+		Status    int    `json:"status"`
+		Error     string `json:"error"`
+		RequestId string `json:"request_id"`
+	}
+	if err := json.Unmarshal(page.Body.Bytes(), &body); err != nil {
+		t.Fatalf("json body %q: %v", page.Body.String(), err)
+	}
+	if body.Status != 502 || body.Error != `say "hi"` || body.RequestId != "req-1" {
+		t.Errorf("json body = %+v", body)
+	}
+
+	//没有配置模板或模板文件不存在时返回纯文本
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		plain := writeTestError(service, status, "failed", "")
+		if plain.Code != status || !strings.HasPrefix(plain.Header().Get("Content-Type"), "text/plain") || !strings.Contains(plain.Body.String(), "Request ID: req-1") {
+			t.Errorf("%d = %s %q, want the plain text page", status, plain.Header().Get("Content-Type"), plain.Body.String())
+		}
+	}
+}
+
+func TestErrorPageReload(t *testing.T) {
+	service, dir := errorPageService(t)
+	if body := writeTestError(service, http.StatusBadGateway, "down", "").Body.String(); !strings.HasPrefix(body, "<p>502") {
+		t.Fatalf("body = %q", body)
+	}
+
+	//修改模板后不需要重启就生效
+	path := filepath.Join(dir, "502.html")
+	writePage(t, path, "<h1>{{.Message}}</h1>")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if body := writeTestError(service, http.StatusBadGateway, "down", "").Body.String(); body != "<h1>down</h1>" {
+		t.Errorf("body after change = %q, want the new template", body)
+	}
+
+	//改坏了的模板不使用，返回纯文本
+	writePage(t, path, "<h1>{{.Message</h1>")
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if plain := writeTestError(service, http.StatusBadGateway, "down", ""); !strings.HasPrefix(plain.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("broken template = %s %q, want the plain text page", plain.Header().Get("Content-Type"), plain.Body.String())
+	}
+}
+
+func TestWantsJson(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "application/json", want: true},
+		{accept: "application/json, text/plain, */*", want: true},
+		{accept: "text/html,application/xhtml+xml,application/json;q=0.9", want: false},
+		{accept: "*/*", want: false},
+		{accept: "", want: false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", test.accept)
+		if got := wantsJson(r); got != test.want {
+			t.Errorf("wantsJson(%q) = %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
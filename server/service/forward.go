@@ -0,0 +1,160 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies 解析可信代理列表，支持 CIDR 和单个 IP
+func parseTrustedProxies(serviceName string, entries []string) []*net.IPNet {
+	return parseNetworks(serviceName, "trusted proxy", entries)
+}
+
+// parseNetworks 解析 CIDR 或单个 IP 的列表，不合法的记录日志后忽略
+func parseNetworks(serviceName string, kind string, entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				if ip.To4() != nil {
+					entry += "/32"
+				} else {
+					entry += "/128"
+				}
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Error("invalid "+kind+", ignore it", zap.String("service", serviceName), zap.String("entry", entry), zap.Error(err))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func (service *Service) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return false
+	}
+	for _, network := range service.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp 取得真实的客户端 IP
+// 直接连接过来的是可信代理时，从 X-Forwarded-For 的右边往左找第一个不是可信代理的地址，没有 X-Forwarded-For 时使用 X-Real-IP
+func (service *Service) clientIp(r *http.Request) string {
+	peer := remoteIp(r)
+	if !service.isTrustedProxy(peer) {
+		return peer
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !service.isTrustedProxy(ip) {
+			return ip
+		}
+		peer = ip
+	}
+
+	if realIp := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIp != "" && net.ParseIP(realIp) != nil {
+		return realIp
+	}
+	return peer
+}
+
+// forwardedProto 客户端使用的协议，只有可信代理传过来的 X-Forwarded-Proto 才会被采用
+func (service *Service) forwardedProto(r *http.Request) string {
+	if service.isTrustedProxy(remoteIp(r)) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedHost 客户端请求的 Host，可信代理传过来的 X-Forwarded-Host 优先
+func (service *Service) forwardedHost(r *http.Request) string {
+	if service.isTrustedProxy(remoteIp(r)) {
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// setForwardHeaders 在转发给实例的请求上设置 X-Forwarded-*、X-Real-IP 和 RFC 7239 Forwarded
+// in 是客户端的原始请求，out 是转发给实例的请求
+func (service *Service) setForwardHeaders(in *http.Request, out *http.Request) {
+	peer := remoteIp(in)
+	trusted := service.isTrustedProxy(peer)
+	proto := service.forwardedProto(in)
+
+	//不是可信代理时丢弃客户端自己带的头，防止伪造；X-Forwarded-For 由 ReverseProxy 在后面追加直接连接的地址
+	if !trusted {
+		out.Header.Del("X-Forwarded-For")
+		out.Header.Del("Forwarded")
+	}
+	out.Header.Set("X-Real-IP", service.clientIp(in))
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", service.forwardedHost(in))
+
+	element := "for=" + forwardedNode(peer) + ";host=" + quoteForwarded(in.Host) + ";proto=" + proto
+	if prior := out.Header.Get("Forwarded"); prior != "" {
+		element = prior + ", " + element
+	}
+	out.Header.Set("Forwarded", element)
+}
+
+// forwardedNode RFC 7239 里 IPv6 地址要加方括号并用引号括起来
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return value
+}
+
+// upstreamHost 转发给实例的 Host：保留客户端请求的 Host，或者改成配置的值，默认是实例的地址
+func (service *Service) upstreamHost(in *http.Request, upstreamAddr string) string {
+	if service.Data.PreserveHost {
+		return in.Host
+	}
+	if service.Data.HostRewrite != "" {
+		return service.Data.HostRewrite
+	}
+	return upstreamAddr
+}
+
+// remoteIp 直接连接过来的地址
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
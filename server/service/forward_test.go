@@ -0,0 +1,76 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	service := &Service{Name: "test", trustedProxies: parseTrustedProxies("test", []string{"10.0.0.0/8", "127.0.0.1", "::1"})}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIp       string
+		want         string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:5000", want: "203.0.113.7"},
+		{name: "untrusted peer ignores headers", remoteAddr: "203.0.113.7:5000", forwardedFor: []string{"1.2.3.4"}, realIp: "5.6.7.8", want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "skip trusted hops from the right", remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"198.51.100.1, 10.0.0.5, 10.0.0.3"}, want: "198.51.100.1"},
+		{name: "spoofed entry left of the client", remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"1.1.1.1, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "several headers", remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"198.51.100.1", "10.0.0.3"}, want: "198.51.100.1"},
+		{name: "empty entries", remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"198.51.100.1,, "}, want: "198.51.100.1"},
+		{name: "all hops trusted", remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"10.0.0.4, 10.0.0.3"}, want: "10.0.0.4"},
+		{name: "real ip without forwarded for", remoteAddr: "127.0.0.1:5000", realIp: "198.51.100.2", want: "198.51.100.2"},
+		{name: "invalid real ip", remoteAddr: "127.0.0.1:5000", realIp: "unknown", want: "127.0.0.1"},
+		{name: "ipv6 trusted proxy", remoteAddr: "[::1]:5000", forwardedFor: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if test.realIp != "" {
+				r.Header.Set("X-Real-IP", test.realIp)
+			}
+			if got := service.clientIp(r); got != test.want {
+				t.Errorf("clientIp() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks := parseNetworks("test", "trusted proxy", []string{"10.0.0.0/8", " 192.168.1.1 ", "::1", "not-an-ip", "300.0.0.1"})
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"}
+	if len(networks) != len(want) {
+		t.Fatalf("parseNetworks() = %v, want %v", networks, want)
+	}
+	for i, network := range networks {
+		if network.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, network, want[i])
+		}
+	}
+}
+
+func TestQuoteForwarded(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", `"example.com:8080"`},
+		{`a"b`, `"a\"b"`},
+	}
+	for _, test := range tests {
+		if got := quoteForwarded(test.value); got != test.want {
+			t.Errorf("quoteForwarded(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+	if got := forwardedNode("2001:db8::1"); got != `"[2001:db8::1]"` {
+		t.Errorf("forwardedNode() = %s", got)
+	}
+}
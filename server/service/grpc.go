@@ -0,0 +1,55 @@
+package service
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gRPC 状态码，见 https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// isGrpcRequest gRPC 请求的 Content-Type 是 application/grpc 或 application/grpc+proto 等
+func isGrpcRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcStatus smoothserve 自己返回的 HTTP 错误对应的 gRPC 状态码，和 gRPC 客户端对 HTTP 状态码的映射一致
+func grpcStatus(httpStatus int) int {
+	switch httpStatus {
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	}
+	return grpcUnknown
+}
+
+// writeGrpcError gRPC 客户端只认 grpc-status，错误以 200 加 Trailers-Only 的形式返回
+func (service *Service) writeGrpcError(w http.ResponseWriter, status int, message string, requestId string) {
+	header := w.Header()
+	header.Set(service.requestIdHeader(), requestId)
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(grpcStatus(status)))
+	header.Set("Grpc-Message", url.PathEscape(message+" (request id "+requestId+")"))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// h2cUpstream 明文 HTTP/2 的实例，记录新建的连接数
+func h2cUpstream(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	connections := new(atomic.Int32)
+	upstream := httptest.NewUnstartedServer(h2c.NewHandler(handler, &http2.Server{}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, connections
+}
+
+func TestH2cProxyTrailers(t *testing.T) {
+	upstream, _ := h2cUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("instance got %s, want HTTP/2", r.Proto)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	service := newTestService(t, config.ServiceData{Upstream: config.UpstreamConfig{Protocol: config.ProtocolH2c}}, upstream)
+
+	r := httptest.NewRequest("POST", "/helloworld.Greeter/SayHello", nil)
+	r.Header.Set("Content-Type", "application/grpc")
+	res := serve(service, r).Result()
+	if res.StatusCode != http.StatusOK || res.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("response = %d, trailers %v, want 200 with grpc-status", res.StatusCode, res.Trailer)
+	}
+}
+
+func TestH2cTransportTimeouts(t *testing.T) {
+	t.Run("response header timeout", func(t *testing.T) {
+		upstream, _ := h2cUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(3 * time.Second):
+			case <-r.Context().Done():
+			}
+		})
+		service := newTestService(t, config.ServiceData{Upstream: config.UpstreamConfig{Protocol: config.ProtocolH2c, ResponseHeaderTimeout: 1}}, upstream)
+		start := time.Now()
+		w := serve(service, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusGatewayTimeout || time.Since(start) > 2*time.Second {
+			t.Errorf("status = %d after %s, want 504 after the header timeout", w.Code, time.Since(start))
+		}
+	})
+
+	t.Run("streaming body is not cut", func(t *testing.T) {
+		upstream, _ := h2cUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("first "))
+			http.NewResponseController(w).Flush()
+			time.Sleep(1500 * time.Millisecond)
+			_, _ = w.Write([]byte("second"))
+		})
+		service := newTestService(t, config.ServiceData{Upstream: config.UpstreamConfig{Protocol: config.ProtocolH2c, ResponseHeaderTimeout: 1}}, upstream)
+		if w := serve(service, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusOK || w.Body.String() != "first second" {
+			t.Errorf("response = %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("idle connections are closed", func(t *testing.T) {
+		upstream, connections := h2cUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+		service := newTestService(t, config.ServiceData{Upstream: config.UpstreamConfig{Protocol: config.ProtocolH2c, IdleConnTimeout: 1}}, upstream)
+		for i := 0; i < 3; i++ {
+			serve(service, httptest.NewRequest("GET", "/", nil))
+		}
+		if got := connections.Load(); got != 1 {
+			t.Fatalf("%d connections for back to back requests, want 1", got)
+		}
+		time.Sleep(1500 * time.Millisecond)
+		serve(service, httptest.NewRequest("GET", "/", nil))
+		if got := connections.Load(); got != 2 {
+			t.Errorf("%d connections after idle_conn_timeout, want a new one", got)
+		}
+	})
+}
+
+func TestGrpcErrors(t *testing.T) {
+	tests := []struct {
+		httpStatus int
+		want       int
+	}{
+		{http.StatusBadGateway, grpcUnavailable},
+		{http.StatusServiceUnavailable, grpcUnavailable},
+		{http.StatusGatewayTimeout, grpcDeadlineExceeded},
+		{http.StatusTooManyRequests, grpcResourceExhausted},
+		{http.StatusUnauthorized, grpcUnauthenticated},
+		{http.StatusForbidden, grpcPermissionDenied},
+		{http.StatusNotFound, grpcUnimplemented},
+		{http.StatusInternalServerError, grpcUnknown},
+	}
+	for _, test := range tests {
+		if got := grpcStatus(test.httpStatus); got != test.want {
+			t.Errorf("grpcStatus(%d) = %d, want %d", test.httpStatus, got, test.want)
+		}
+	}
+
+	//没有可用实例时 gRPC 客户端收到的是 200 和 grpc-status
+	service := newTestService(t, config.ServiceData{Upstream: config.UpstreamConfig{Protocol: config.ProtocolH2c}}, deadUpstream())
+	r := httptest.NewRequest("POST", "/helloworld.Greeter/SayHello", nil)
+	r.Header.Set("Content-Type", "application/grpc+proto")
+	r.Header.Set("X-Request-ID", "grpc-1")
+	w := serve(service, r)
+	if w.Code != http.StatusOK || w.Header().Get("Grpc-Status") != "14" || w.Header().Get("X-Request-ID") != "grpc-1" {
+		t.Errorf("response = %d %v, want 200 with grpc-status 14", w.Code, w.Header())
+	}
+}
+
+func TestIsGrpcRequest(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/grpc":                true,
+		"application/grpc+proto":          true,
+		"application/grpc; charset=utf-8": true,
+		"application/grpc-web":            false,
+		"application/json":                false,
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("Content-Type", contentType)
+		if got := isGrpcRequest(r); got != want {
+			t.Errorf("isGrpcRequest(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// htpasswdFile htpasswd 文件里的用户，文件修改后下次认证时重新读取，不需要重启
+type htpasswdFile struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string][]byte //用户名 -> bcrypt 哈希
+	// verified 验证通过的用户和密码的 sha256，bcrypt 很慢，同一个密码不用每个请求都算一遍；文件变化时清空
+	verified map[string][32]byte
+	// dummyHash 用户不存在时也算一次 bcrypt，响应时间不会暴露用户名是否存在；cost 和文件里的哈希相同
+	dummyHash []byte
+}
+
+func newHtpasswdFile(path string) *htpasswdFile {
+	return &htpasswdFile{path: path}
+}
+
+// verify 检查用户名和密码；文件读取失败时返回错误，调用方拒绝请求
+func (file *htpasswdFile) verify(username string, password string) (bool, error) {
+	file.mutex.Lock()
+	if err := file.reload(); err != nil {
+		file.mutex.Unlock()
+		return false, err
+	}
+	hash, ok := file.users[username]
+	sum := sha256.Sum256([]byte(password))
+	cached, hit := file.verified[username]
+	dummyHash := file.dummyHash
+	file.mutex.Unlock()
+	if !ok {
+		if dummyHash != nil {
+			_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		}
+		return false, nil
+	}
+	if hit && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true, nil
+	}
+
+	//bcrypt 在锁外面算，不阻塞其它请求
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false, nil
+	}
+	file.mutex.Lock()
+	if bytes.Equal(file.users[username], hash) {
+		file.verified[username] = sum
+	}
+	file.mutex.Unlock()
+	return true, nil
+}
+
+// reload 文件有变化时重新读取，需要持有锁
+func (file *htpasswdFile) reload() error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return err
+	}
+	if file.users != nil && info.ModTime().Equal(file.modTime) && info.Size() == file.size {
+		return nil
+	}
+	users, err := parseHtpasswd(file.path)
+	if err != nil {
+		return err
+	}
+	file.users = users
+	file.verified = make(map[string][32]byte)
+	file.dummyHash = nil
+	for _, hash := range users {
+		if cost, err := bcrypt.Cost(hash); err == nil {
+			file.dummyHash, _ = bcrypt.GenerateFromPassword([]byte(file.path), cost)
+		}
+		break
+	}
+	file.modTime = info.ModTime()
+	file.size = info.Size()
+	return nil
+}
+
+// parseHtpasswd 每行一个 用户名:哈希，只支持 bcrypt（$2y$、$2a$、$2b$），# 开头的是注释
+func parseHtpasswd(path string) (map[string][]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s line %d: expect username:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s line %d: user %s is not a bcrypt hash, create it with htpasswd -B", path, line, username)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeHtpasswd 写一个测试用的 htpasswd 文件，密码用最小的 cost 加快测试
+func writeHtpasswd(t *testing.T, path string, users map[string]string) {
+	t.Helper()
+	content := "# test users\n\n"
+	for username, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += username + ":" + string(hash) + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		content   string
+		wantUsers []string
+		wantErr   bool
+	}{
+		{name: "users and comments", content: "# admins\nalice:" + string(hash) + "\n\n  bob:" + string(hash) + "  \n", wantUsers: []string{"alice", "bob"}},
+		{name: "empty file", content: "", wantUsers: nil},
+		{name: "missing colon", content: "alice\n", wantErr: true},
+		{name: "empty username", content: ":" + string(hash) + "\n", wantErr: true},
+		{name: "apr1 md5 hash", content: "alice:$apr1$abc$def\n", wantErr: true},
+		{name: "sha1 hash", content: "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			users, err := parseHtpasswd(path)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseHtpasswd() = %v, want an error", users)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != len(test.wantUsers) {
+				t.Fatalf("parseHtpasswd() has %d users, want %v", len(users), test.wantUsers)
+			}
+			for _, username := range test.wantUsers {
+				if users[username] == nil {
+					t.Errorf("user %s is missing", username)
+				}
+			}
+		})
+	}
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "secret"})
+	file := newHtpasswdFile(path)
+
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "secret", true}, //第二次走缓存
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+	}
+	for _, test := range tests {
+		valid, err := file.verify(test.username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != test.want {
+			t.Errorf("verify(%s, %s) = %v, want %v", test.username, test.password, valid, test.want)
+		}
+	}
+	//不存在的用户也和同样 cost 的哈希比较一次
+	if cost, err := bcrypt.Cost(file.dummyHash); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("dummy hash cost = %d, %v, want %d", cost, err, bcrypt.MinCost)
+	}
+
+	//修改文件后旧密码马上失效，不会用到缓存
+	writeHtpasswd(t, path, map[string]string{"alice": "changed", "bob": "secret"})
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := file.verify("alice", "secret"); valid {
+		t.Error("old password is still accepted after the file changed")
+	}
+	if valid, _ := file.verify("alice", "changed"); !valid {
+		t.Error("new password is rejected")
+	}
+	if valid, _ := file.verify("bob", "secret"); !valid {
+		t.Error("new user is rejected")
+	}
+
+	//文件读不了时返回错误，调用方拒绝请求
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := file.verify("alice", "changed"); valid || err == nil {
+		t.Errorf("verify() after the file was removed = %v, %v, want false and an error", valid, err)
+	}
+}
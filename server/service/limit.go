@@ -0,0 +1,231 @@
+package service
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"smoothserver/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// limitedInstance 被限流或超过并发上限直接返回的请求在指标里的 instance 标签
+	limitedInstance = "limited"
+
+	defaultLimitRetryAfter = 1
+
+	// maxHeaderBuckets 桶的数量达到后不再为新的请求头值建桶，改按 IP 计数，避免随意的头把内存撑满
+	maxHeaderBuckets = 100000
+)
+
+// tokenBucket 一个 key 的令牌桶，取令牌时按经过的时间补充
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter 一条限流规则，按 key 分桶
+type rateLimiter struct {
+	config.RateLimitConfig
+	burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiters(limits []config.RateLimitConfig) []*rateLimiter {
+	var limiters []*rateLimiter
+	for _, limit := range limits {
+		burst := float64(limit.Burst)
+		if burst <= 0 {
+			burst = math.Ceil(limit.Rate)
+		}
+		limiters = append(limiters, &rateLimiter{RateLimitConfig: limit, burst: burst, buckets: make(map[string]*tokenBucket)})
+	}
+	return limiters
+}
+
+// matches 请求是否受这条规则限制
+func (limiter *rateLimiter) matches(r *http.Request) bool {
+	if len(limiter.Methods) > 0 && !slices.ContainsFunc(limiter.Methods, func(method string) bool { return strings.EqualFold(method, r.Method) }) {
+		return false
+	}
+	return limiter.PathPrefix == "" || hasPathPrefix(clientPath(r), limiter.PathPrefix)
+}
+
+// key 请求计入哪个桶；按请求头限流时没有这个头的请求按 IP 计数，避免不带头就能绕过限制
+func (limiter *rateLimiter) key(service *Service, r *http.Request) string {
+	switch limiter.Key {
+	case config.RateLimitRoute:
+		return ""
+	case config.RateLimitHeader:
+		if value := r.Header.Get(limiter.Header); value != "" && limiter.hasRoom("header:"+value) {
+			return "header:" + value
+		}
+	}
+	return service.clientIp(r)
+}
+
+// hasRoom key 已经有桶，或者还可以再建一个桶
+func (limiter *rateLimiter) hasRoom(key string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.buckets[key] != nil || len(limiter.buckets) < maxHeaderBuckets
+}
+
+// take 从 key 的桶里取一个令牌，没有令牌时返回还要等多久
+func (limiter *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.sweep(now)
+
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = min(limiter.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.Rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / limiter.Rate * float64(time.Second))
+}
+
+// sweep 每分钟删除一次已经补满的桶，按 IP 限流时桶的数量不会一直增长
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Minute {
+		return
+	}
+	limiter.lastSweep = now
+	refill := time.Duration(limiter.burst / limiter.Rate * float64(time.Second))
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// clientPath 客户端请求的路径，不受路由的 strip_prefix 和 rewrite 影响
+func clientPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+// checkRateLimits 依次检查限流规则，超过时返回 429，返回 true 表示请求已经处理完
+func (service *Service) checkRateLimits(w http.ResponseWriter, r *http.Request, requestId string) bool {
+	now := time.Now()
+	for _, limiter := range service.rateLimiters {
+		if !limiter.matches(r) {
+			continue
+		}
+		if ok, wait := limiter.take(limiter.key(service, r), now); !ok {
+			service.rejectRequest(w, r, http.StatusTooManyRequests, "Too many requests", requestId, "rate_limit", retryAfterSeconds(wait))
+			return true
+		}
+	}
+	return false
+}
+
+// enterConcurrency 服务同时转发的请求没有达到上限时占用一个位置，返回 false 时不用 leave
+func (service *Service) enterConcurrency() bool {
+	maxRequests := int64(service.Data.Concurrency.MaxRequests)
+	if maxRequests <= 0 {
+		return true
+	}
+	if service.activeRequests.Add(1) > maxRequests {
+		service.activeRequests.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (service *Service) leaveConcurrency() {
+	if service.Data.Concurrency.MaxRequests > 0 {
+		service.activeRequests.Add(-1)
+	}
+}
+
+// acquireInstance 实例同时处理的请求没有达到上限时占用一个位置，用完后要调用 releaseInstance
+func (service *Service) acquireInstance(instance *Instance) bool {
+	maxPerInstance := int64(service.Data.Concurrency.MaxPerInstance)
+	for {
+		active := instance.activeRequests.Load()
+		if maxPerInstance > 0 && active >= maxPerInstance {
+			return false
+		}
+		if instance.activeRequests.CompareAndSwap(active, active+1) {
+			return true
+		}
+	}
+}
+
+// releaseInstance 实例有了空位时唤醒排队的请求
+func (service *Service) releaseInstance(instance *Instance) {
+	instance.activeRequests.Add(-1)
+	if service.Data.Concurrency.MaxPerInstance > 0 {
+		service.ready.notify()
+	}
+}
+
+// instancesBusy 有可以服务的实例，并且它们都达到了并发上限
+func (service *Service) instancesBusy() bool {
+	maxPerInstance := int64(service.Data.Concurrency.MaxPerInstance)
+	if maxPerInstance <= 0 {
+		return false
+	}
+	busy := false
+	for _, instance := range service.Instances() {
+		if instance == nil || instance.Status.Load() < StatusWaitingStop {
+			continue
+		}
+		if instance.activeRequests.Load() < maxPerInstance {
+			return false
+		}
+		busy = true
+	}
+	return busy
+}
+
+// releaseSlots 释放请求占用的实例和服务的并发位置，同一个请求只释放一次
+func (service *Service) releaseSlots(pc *proxyContext) {
+	if pc.slotsReleased {
+		return
+	}
+	pc.slotsReleased = true
+	service.releaseInstance(pc.instance)
+	service.leaveConcurrency()
+}
+
+// concurrencyRetryAfter 超过并发上限时的 Retry-After
+func (service *Service) concurrencyRetryAfter() int {
+	if service.Data.Concurrency.RetryAfter > 0 {
+		return service.Data.Concurrency.RetryAfter
+	}
+	return defaultLimitRetryAfter
+}
+
+// rejectRequest 返回 429 或 503 和 Retry-After，统计被拒绝的原因并记录访问日志
+func (service *Service) rejectRequest(w http.ResponseWriter, r *http.Request, status int, message string, requestId string, reason string, retryAfter int) {
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+	recorder.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	service.writeError(recorder, r, status, message, requestId)
+
+	limitRejected.Inc(service.Name, reason)
+	requestsTotal.Inc(service.Name, limitedInstance, statusClass(status))
+	service.accessLog.Log(service.newAccessEntry(r, recorder, start, requestId))
+}
+
+// retryAfterSeconds Retry-After 只能是整数秒，向上取整，最少1秒
+func retryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"net/http/httptest"
+	"smoothserver/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type attempt struct {
+		at       time.Duration //距离第一次请求的时间
+		wantOk   bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name     string
+		limit    config.RateLimitConfig
+		attempts []attempt
+	}{
+		{
+			name:  "burst then rate",
+			limit: config.RateLimitConfig{Rate: 2, Burst: 3},
+			attempts: []attempt{
+				{0, true, 0}, {0, true, 0}, {0, true, 0},
+				{0, false, 500 * time.Millisecond},
+				{250 * time.Millisecond, false, 250 * time.Millisecond},
+				{500 * time.Millisecond, true, 0},
+				{500 * time.Millisecond, false, 500 * time.Millisecond},
+			},
+		},
+		{
+			name:  "refill is capped at burst",
+			limit: config.RateLimitConfig{Rate: 10, Burst: 2},
+			attempts: []attempt{
+				{0, true, 0},
+				{time.Hour, true, 0}, {time.Hour, true, 0},
+				{time.Hour, false, 100 * time.Millisecond},
+			},
+		},
+		{
+			name:  "burst defaults to the rate rounded up",
+			limit: config.RateLimitConfig{Rate: 0.5},
+			attempts: []attempt{
+				{0, true, 0},
+				{0, false, 2 * time.Second},
+				{time.Second, false, time.Second},
+				{2 * time.Second, true, 0},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiters([]config.RateLimitConfig{test.limit})[0]
+			start := time.Now()
+			for i, attempt := range test.attempts {
+				ok, wait := limiter.take("key", start.Add(attempt.at))
+				if ok != attempt.wantOk || (wait-attempt.wantWait).Abs() > time.Millisecond {
+					t.Errorf("attempt %d at %s: take() = %v, %s, want %v, %s", i, attempt.at, ok, wait, attempt.wantOk, attempt.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketKeys(t *testing.T) {
+	limiter := newRateLimiters([]config.RateLimitConfig{{Rate: 1}})[0]
+	now := time.Now()
+	if ok, _ := limiter.take("a", now); !ok {
+		t.Fatal("first request of a is limited")
+	}
+	if ok, _ := limiter.take("a", now); ok {
+		t.Error("second request of a is not limited")
+	}
+	if ok, _ := limiter.take("b", now); !ok {
+		t.Error("b shares the bucket of a")
+	}
+
+	//补满的桶在下一次清理时删除
+	limiter.take("c", now.Add(2*time.Minute))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets after sweep, want 1", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterMatchAndKey(t *testing.T) {
+	service := &Service{Name: "test", trustedProxies: parseTrustedProxies("test", []string{"127.0.0.1"})}
+	tests := []struct {
+		name      string
+		limit     config.RateLimitConfig
+		method    string
+		target    string
+		header    string
+		wantMatch bool
+		wantKey   string
+	}{
+		{name: "all requests by ip", limit: config.RateLimitConfig{Key: config.RateLimitIp}, target: "/x", wantMatch: true, wantKey: "198.51.100.1"},
+		{name: "prefix", limit: config.RateLimitConfig{PathPrefix: "/api"}, target: "/api/users", wantMatch: true, wantKey: "198.51.100.1"},
+		{name: "prefix by segment", limit: config.RateLimitConfig{PathPrefix: "/api"}, target: "/apis", wantMatch: false},
+		{name: "method", limit: config.RateLimitConfig{Methods: []string{"post"}}, method: "POST", target: "/", wantMatch: true, wantKey: "198.51.100.1"},
+		{name: "method miss", limit: config.RateLimitConfig{Methods: []string{"POST"}}, target: "/", wantMatch: false},
+		{name: "header", limit: config.RateLimitConfig{Key: config.RateLimitHeader, Header: "X-Api-Key"}, target: "/", header: "k1", wantMatch: true, wantKey: "header:k1"},
+		{name: "header missing falls back to ip", limit: config.RateLimitConfig{Key: config.RateLimitHeader, Header: "X-Api-Key"}, target: "/", wantMatch: true, wantKey: "198.51.100.1"},
+		{name: "route shares one bucket", limit: config.RateLimitConfig{Key: config.RateLimitRoute}, target: "/", wantMatch: true, wantKey: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiters([]config.RateLimitConfig{test.limit})[0]
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, test.target, nil)
+			r.RemoteAddr = "127.0.0.1:5000"
+			r.Header.Set("X-Forwarded-For", "198.51.100.1")
+			if test.header != "" {
+				r.Header.Set("X-Api-Key", test.header)
+			}
+			if got := limiter.matches(r); got != test.wantMatch {
+				t.Fatalf("matches() = %v, want %v", got, test.wantMatch)
+			}
+			if !test.wantMatch {
+				return
+			}
+			if got := limiter.key(service, r); got != test.wantKey {
+				t.Errorf("key() = %q, want %q", got, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestRateLimiterHeaderBucketCap(t *testing.T) {
+	service := &Service{Name: "test"}
+	limiter := newRateLimiters([]config.RateLimitConfig{{Rate: 1, Key: config.RateLimitHeader, Header: "X-Api-Key"}})[0]
+	limiter.buckets["header:known"] = &tokenBucket{}
+	for i := len(limiter.buckets); i < maxHeaderBuckets; i++ {
+		limiter.buckets[strconv.Itoa(i)] = &tokenBucket{}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.1:5000"
+	r.Header.Set("X-Api-Key", "new")
+	if got := limiter.key(service, r); got != "198.51.100.1" {
+		t.Errorf("key() with full buckets = %q, want the client ip", got)
+	}
+	r.Header.Set("X-Api-Key", "known")
+	if got := limiter.key(service, r); got != "header:known" {
+		t.Errorf("key() of an existing bucket = %q, want header:known", got)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{0, 1},
+		{100 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	}
+	for _, test := range tests {
+		if got := retryAfterSeconds(test.wait); got != test.want {
+			t.Errorf("retryAfterSeconds(%s) = %d, want %d", test.wait, got, test.want)
+		}
+	}
+}
+
+func TestInstancesBusy(t *testing.T) {
+	instance := func(status int32, active int64) *Instance {
+		i := &Instance{}
+		i.Status.Store(status)
+		i.activeRequests.Store(active)
+		return i
+	}
+	tests := []struct {
+		name           string
+		maxPerInstance int
+		instances      []*Instance
+		want           bool
+	}{
+		{name: "no cap", maxPerInstance: 0, instances: []*Instance{instance(StatusRunning, 100)}, want: false},
+		{name: "all full", maxPerInstance: 2, instances: []*Instance{instance(StatusRunning, 2), instance(StatusWaitingStop, 2)}, want: true},
+		{name: "one has room", maxPerInstance: 2, instances: []*Instance{instance(StatusRunning, 2), instance(StatusRunning, 1)}, want: false},
+		{name: "stopped instances are not busy", maxPerInstance: 2, instances: []*Instance{instance(StatusStopped, 0), instance(StatusWillRunning, 0), nil}, want: false},
+		{name: "full and stopped", maxPerInstance: 1, instances: []*Instance{instance(StatusRunning, 1), instance(StatusStopped, 0)}, want: true},
+		{name: "no instances", maxPerInstance: 1, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", Data: config.ServiceData{Concurrency: config.ConcurrencyConfig{MaxPerInstance: test.maxPerInstance}}}
+			service.storeInstances(test.instances)
+			if got := service.instancesBusy(); got != test.want {
+				t.Errorf("instancesBusy() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConcurrencySlots(t *testing.T) {
+	service := &Service{Name: "test", Data: config.ServiceData{Concurrency: config.ConcurrencyConfig{MaxRequests: 1, MaxPerInstance: 1}}}
+	instance := &Instance{}
+	instance.Status.Store(StatusRunning)
+	service.storeInstances([]*Instance{instance})
+
+	if !service.enterConcurrency() {
+		t.Fatal("first request is over max_requests")
+	}
+	if service.enterConcurrency() {
+		t.Fatal("second request is under max_requests")
+	}
+	if selected := service.SelectInstance(); selected != instance {
+		t.Fatalf("SelectInstance() = %v", selected)
+	}
+	if service.SelectInstance() != nil {
+		t.Fatal("full instance is selected")
+	}
+
+	//长连接建立后释放位置，只释放一次
+	pc := &proxyContext{instance: instance}
+	service.releaseSlots(pc)
+	service.releaseSlots(pc)
+	if instance.activeRequests.Load() != 0 || service.activeRequests.Load() != 0 {
+		t.Errorf("slots after release: instance %d, service %d, want 0", instance.activeRequests.Load(), service.activeRequests.Load())
+	}
+}
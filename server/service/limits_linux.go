@@ -0,0 +1,216 @@
+//go:build linux
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"smoothserver/config"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	defaultCgroupRoot = "/sys/fs/cgroup/smoothserve"
+	cgroupMount       = "/sys/fs/cgroup"
+	cpuPeriod         = 100000
+)
+
+// instanceLimits 一个实例进程的资源限制，cgroup 为空表示没有使用 cgroup
+type instanceLimits struct {
+	service  *Service
+	limits   config.ResourceLimits
+	cgroup   string
+	cgroupFd *os.File
+	oomKills int //启动时 cgroup 里已有的 oom_kill 次数
+}
+
+// prepareLimits 在启动实例前创建 cgroup，并让进程直接在这个 cgroup 里启动
+func (service *Service) prepareLimits(cmd *exec.Cmd, data *config.ServiceData, port int) (*instanceLimits, error) {
+	limits := data.Limits
+	if limits.IsEmpty() {
+		return nil, nil
+	}
+
+	instance := &instanceLimits{service: service, limits: limits}
+	if !cgroupV2Available() {
+		if limits.CpuWeight != 0 || limits.CpuQuota != 0 || limits.MaxPids != 0 {
+			log.Error("cgroup v2 is not available, cpu and pids limits are ignored", zap.String("service", service.Name))
+		}
+		return instance, nil
+	}
+
+	path, err := service.createCgroup(port, limits)
+	if err != nil {
+		return nil, err
+	}
+	instance.cgroup = path
+	instance.oomKills = readOomKills(path)
+
+	fd, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("open cgroup %s: %w", path, err)
+	}
+	instance.cgroupFd = fd
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(fd.Fd())
+	return instance, nil
+}
+
+// needsRlimit 有需要通过 rlimit 设置的限制，实例要等 started 设置好以后再运行
+func (instance *instanceLimits) needsRlimit() bool {
+	if instance == nil {
+		return false
+	}
+	return instance.limits.MaxOpenFiles > 0 || instance.limits.MaxMemory != "" && instance.cgroup == ""
+}
+
+// started 进程启动后（exec 实例之前）设置 rlimit，没有 cgroup 时内存通过 RLIMIT_AS 限制
+func (instance *instanceLimits) started(pid int) error {
+	if instance == nil {
+		return nil
+	}
+	if instance.cgroupFd != nil {
+		_ = instance.cgroupFd.Close()
+		instance.cgroupFd = nil
+	}
+
+	limits := instance.limits
+	if limits.MaxOpenFiles > 0 {
+		rlimit := unix.Rlimit{Cur: limits.MaxOpenFiles, Max: limits.MaxOpenFiles}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, &rlimit, nil); err != nil {
+			return fmt.Errorf("set max_open_files: %w", err)
+		}
+	}
+	if limits.MaxMemory != "" && instance.cgroup == "" {
+		size, err := config.ParseSize(limits.MaxMemory)
+		if err != nil {
+			return err
+		}
+		rlimit := unix.Rlimit{Cur: size, Max: size}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &rlimit, nil); err != nil {
+			return fmt.Errorf("set max_memory: %w", err)
+		}
+	}
+	return nil
+}
+
+// exited 进程退出后检查是否被 OOM killer 杀掉，并清理 cgroup
+func (instance *instanceLimits) exited() (oomKilled bool) {
+	if instance == nil || instance.cgroup == "" {
+		return false
+	}
+	if instance.cgroupFd != nil {
+		_ = instance.cgroupFd.Close()
+		instance.cgroupFd = nil
+	}
+	oomKilled = readOomKills(instance.cgroup) > instance.oomKills
+
+	//还有残留进程时删除会失败，保留下来方便排查
+	if err := os.Remove(instance.cgroup); err != nil {
+		log.Error("remove instance cgroup failed", zap.String("cgroup", instance.cgroup), zap.Error(err))
+	}
+	return oomKilled
+}
+
+func cgroupV2Available() bool {
+	_, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers"))
+	return err == nil
+}
+
+// createCgroup 创建 <root>/<service>/instance-<index>，并写入限制
+func (service *Service) createCgroup(port int, limits config.ResourceLimits) (string, error) {
+	root := config.ConfigData.CgroupRoot
+	if root == "" {
+		root = defaultCgroupRoot
+	}
+	servicePath := filepath.Join(root, service.Name)
+	path := filepath.Join(servicePath, fmt.Sprintf("instance-%d", service.instanceIndexOf(port)))
+
+	if err := os.MkdirAll(servicePath, 0755); err != nil {
+		return "", fmt.Errorf("create cgroup %s: %w", servicePath, err)
+	}
+	//从 cgroup 挂载点开始，逐级打开子树需要的控制器
+	rel, err := filepath.Rel(cgroupMount, servicePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("cgroup root %s is not under %s", root, cgroupMount)
+	}
+	dir := cgroupMount
+	enableControllers(dir)
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		enableControllers(dir)
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("create cgroup %s: %w", path, err)
+	}
+
+	files := map[string]string{}
+	if limits.MaxMemory != "" {
+		size, err := config.ParseSize(limits.MaxMemory)
+		if err != nil {
+			return "", err
+		}
+		files["memory.max"] = strconv.FormatUint(size, 10)
+		//不使用 swap，否则超过限制时只会变慢而不会被 OOM 杀掉
+		files["memory.swap.max"] = "0"
+	}
+	if limits.CpuWeight > 0 {
+		files["cpu.weight"] = strconv.Itoa(limits.CpuWeight)
+	}
+	if limits.CpuQuota > 0 {
+		files["cpu.max"] = fmt.Sprintf("%d %d", int(limits.CpuQuota*cpuPeriod), cpuPeriod)
+	}
+	if limits.MaxPids > 0 {
+		files["pids.max"] = strconv.Itoa(limits.MaxPids)
+	}
+	for name, value := range files {
+		err := os.WriteFile(filepath.Join(path, name), []byte(value), 0644)
+		if err != nil {
+			if name == "memory.swap.max" {
+				continue
+			}
+			_ = os.Remove(path)
+			return "", fmt.Errorf("write %s to cgroup %s: %w", name, path, err)
+		}
+	}
+	return path, nil
+}
+
+// enableControllers 打开子 cgroup 需要的控制器，已经打开或者不支持时忽略错误
+func enableControllers(path string) {
+	for _, controller := range []string{"+cpu", "+memory", "+pids"} {
+		_ = os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(controller), 0644)
+	}
+}
+
+func readOomKills(path string) int {
+	file, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
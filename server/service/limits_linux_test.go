@@ -0,0 +1,93 @@
+//go:build linux
+
+package service
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+)
+
+func TestNeedsRlimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance *instanceLimits
+		want     bool
+	}{
+		{name: "no limits", instance: nil, want: false},
+		{name: "open files", instance: &instanceLimits{limits: config.ResourceLimits{MaxOpenFiles: 1024}}, want: true},
+		{name: "memory without cgroup", instance: &instanceLimits{limits: config.ResourceLimits{MaxMemory: "1G"}}, want: true},
+		{name: "memory in cgroup", instance: &instanceLimits{limits: config.ResourceLimits{MaxMemory: "1G"}, cgroup: "/sys/fs/cgroup/x"}, want: false},
+		{name: "cpu only", instance: &instanceLimits{limits: config.ResourceLimits{CpuWeight: 200}, cgroup: "/sys/fs/cgroup/x"}, want: false},
+	}
+	for _, test := range tests {
+		if got := test.instance.needsRlimit(); got != test.want {
+			t.Errorf("%s: needsRlimit() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestStartedSetsRlimit 实例等 started 设置好 rlimit 以后才 exec，看到的是限制后的值
+func TestStartedSetsRlimit(t *testing.T) {
+	limits := &instanceLimits{limits: config.ResourceLimits{MaxOpenFiles: 123}}
+	cmd := exec.Command("/bin/sh", "-c", "ulimit -n")
+	ready, err := useLauncher(cmd, "", limits.needsRlimit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output strings.Builder
+	cmd.Stdout = &output
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err = limits.started(cmd.Process.Pid); err != nil {
+		releaseLauncher(cmd, ready, false)
+		_ = cmd.Wait()
+		t.Fatal(err)
+	}
+	releaseLauncher(cmd, ready, true)
+	if err = cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(output.String()); got != "123" {
+		t.Errorf("instance open files limit = %s, want 123", got)
+	}
+}
+
+// TestLauncherNotReleased 设置限制失败时不发送就绪信号，实例不会运行
+func TestLauncherNotReleased(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	cmd := exec.Command("/bin/sh", "-c", "touch "+marker)
+	ready, err := useLauncher(cmd, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	releaseLauncher(cmd, ready, false)
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 126 {
+		t.Errorf("Wait() = %v, want exit code 126", err)
+	}
+	if _, err = os.Stat(marker); err == nil {
+		t.Error("instance ran without the ready signal")
+	}
+}
+
+func TestReadOomKills(t *testing.T) {
+	dir := t.TempDir()
+	if got := readOomKills(dir); got != 0 {
+		t.Errorf("readOomKills() without memory.events = %d", got)
+	}
+	content := "low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\noom_group_kill 0\n"
+	if err := os.WriteFile(filepath.Join(dir, "memory.events"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOomKills(dir); got != 2 {
+		t.Errorf("readOomKills() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"os/exec"
+	"smoothserver/config"
+)
+
+type instanceLimits struct{}
+
+func (service *Service) prepareLimits(cmd *exec.Cmd, data *config.ServiceData, port int) (*instanceLimits, error) {
+	if !data.Limits.IsEmpty() {
+		return nil, errors.New("resource limits are only supported on linux")
+	}
+	return nil, nil
+}
+
+func (instance *instanceLimits) needsRlimit() bool {
+	return false
+}
+
+func (instance *instanceLimits) started(pid int) error {
+	return nil
+}
+
+func (instance *instanceLimits) exited() bool {
+	return false
+}
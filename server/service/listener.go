@@ -0,0 +1,245 @@
+package service
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"slices"
+	"smoothserver/config"
+	"strings"
+	"sync"
+)
+
+// portListener 一个端口上的监听，多个服务（不同的 server_name，或同一个域名下不同的路由规则）可以共用一个端口
+type portListener struct {
+	port           int
+	tls            bool
+	mutex          sync.RWMutex
+	routes         []*route       //按优先级排好序的路由，修改时整个替换，读取时不需要一直持有锁
+	hostOrders     map[string]int //域名第一次注册的顺序
+	defaultService *Service       //default_server，没有匹配的域名时处理请求
+	fallback       *Service       //客户端没有发送 SNI 或者没有匹配的服务时使用，默认服务或者第一个注册的服务
+}
+
+// hostDefault 默认服务的路由排在所有域名之后
+const hostDefault = config.HostRegex + 1
+
+// route 端口上的一条路由：域名加上服务的一条路由规则
+type route struct {
+	host      *config.HostPattern //nil 表示默认服务，匹配所有域名
+	hostOrder int                 //多个正则都匹配时先注册的优先
+	rule      *routeRule
+	service   *Service
+	handler   http.HandlerFunc
+	order     int //注册的顺序，其它都相同时先注册的优先
+}
+
+func (route *route) hostKind() int {
+	if route.host == nil {
+		return hostDefault
+	}
+	return route.host.Kind
+}
+
+// hostLength 通配符越长越具体
+func (route *route) hostLength() int {
+	if route.host == nil || route.host.Kind == config.HostRegex {
+		return 0
+	}
+	return len(route.host.Value)
+}
+
+var (
+	listenersMutex sync.Mutex
+	listeners      = make(map[int]*portListener)
+)
+
+// getListener 取得端口上的监听，第一次使用时开始监听；同一个端口不能同时用于 HTTP 和 HTTPS
+func getListener(port int, useTls bool) (*portListener, error) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	if listener, ok := listeners[port]; ok {
+		if listener.tls != useTls {
+			return nil, fmt.Errorf("port %d is already used for %s", port, listener.scheme())
+		}
+		return listener, nil
+	}
+
+	listener := &portListener{port: port, tls: useTls, hostOrders: make(map[string]int)}
+	listeners[port] = listener
+	go listener.serve()
+	return listener, nil
+}
+
+func (listener *portListener) scheme() string {
+	if listener.tls {
+		return "https"
+	}
+	return "http"
+}
+
+func (listener *portListener) serve() {
+	// h2c 让 gRPC 等 HTTP/2 客户端可以直接以明文 HTTP/2 连接，HTTP/1.1 请求不受影响；HTTPS 时通过 ALPN 协商 HTTP/2
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", listener.port),
+		Handler: h2c.NewHandler(listener, &http2.Server{}),
+	}
+
+	var err error
+	if listener.tls {
+		server.TLSConfig = &tls.Config{
+			GetConfigForClient: listener.configForClient,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				serviceConfig, err := listener.configForClient(hello)
+				if err != nil {
+					return nil, err
+				}
+				return serviceConfig.GetCertificate(hello)
+			},
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("port  is in use,connect closed.", zap.Int("port", listener.port), zap.Error(err))
+		} else {
+			log.Error("Failed to listen", zap.Int("port", listener.port), zap.Error(err))
+		}
+	}
+}
+
+// handle 把服务的一个域名和它的路由规则注册到这个端口上
+func (listener *portListener) handle(serverName string, service *Service, rules []*routeRule, handler http.HandlerFunc) {
+	host, err := config.ParseHostPattern(serverName)
+	if err != nil {
+		log.Error("invalid server_name, skip it", zap.String("service", service.Name), zap.Error(err))
+		return
+	}
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if _, ok := listener.hostOrders[host.Value]; !ok {
+		listener.hostOrders[host.Value] = len(listener.hostOrders)
+	}
+	listener.addRoutes(&host, listener.hostOrders[host.Value], service, rules, handler)
+	if listener.fallback == nil {
+		listener.fallback = service
+	}
+}
+
+// handleDefault 把服务注册为端口的默认服务，处理所有没有匹配到域名的请求
+func (listener *portListener) handleDefault(service *Service, rules []*routeRule, handler http.HandlerFunc) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if listener.defaultService != nil && listener.defaultService != service {
+		log.Error("port already has a default_server, ignore it", zap.Int("port", listener.port),
+			zap.String("service", service.Name), zap.String("default_server", listener.defaultService.Name))
+		return
+	}
+	listener.defaultService = service
+	listener.fallback = service
+	listener.addRoutes(nil, 0, service, rules, handler)
+}
+
+// addRoutes 调用时需要持有锁
+// 先按域名排序：完全匹配、开头的通配符（长的优先）、结尾的通配符（长的优先）、正则（先注册的优先）、默认服务；
+// 同一个域名下优先级高的在前，相同时完全匹配、前缀（长的优先）、正则。一个域名下的规则都不匹配时继续尝试下一个匹配的域名
+func (listener *portListener) addRoutes(host *config.HostPattern, hostOrder int, service *Service, rules []*routeRule, handler http.HandlerFunc) {
+	routes := slices.Clone(listener.routes)
+	for _, rule := range rules {
+		routes = append(routes, &route{host: host, hostOrder: hostOrder, rule: rule, service: service, handler: handler, order: len(routes)})
+	}
+	slices.SortStableFunc(routes, func(a, b *route) int {
+		return cmp.Or(
+			cmp.Compare(a.hostKind(), b.hostKind()),
+			cmp.Compare(b.hostLength(), a.hostLength()),
+			cmp.Compare(a.hostOrder, b.hostOrder),
+			cmp.Compare(b.rule.priority(), a.rule.priority()),
+			cmp.Compare(a.rule.kind(), b.rule.kind()),
+			cmp.Compare(b.rule.prefixLength(), a.rule.prefixLength()),
+			cmp.Compare(a.order, b.order),
+		)
+	})
+	listener.routes = routes
+}
+
+// ServeHTTP 按域名和路由规则找到处理请求的服务
+func (listener *portListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := requestHost(r)
+
+	listener.mutex.RLock()
+	routes := listener.routes
+	listener.mutex.RUnlock()
+	for _, route := range routes {
+		if route.host != nil && !route.host.Match(host) {
+			continue
+		}
+		if path, ok := route.rule.match(r); ok {
+			route.rule.handler(route.handler)(w, route.rule.rewriteRequest(r, path))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// requestHost 请求的域名，去掉端口和末尾的点，转成小写
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// configForClient 按 SNI 找到对应的服务（和请求的域名一样匹配），使用服务自己的证书、最低版本和加密套件
+func (listener *portListener) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	listener.mutex.RLock()
+	service := listener.fallback
+	for _, route := range listener.routes {
+		if route.host == nil || route.host.Match(name) {
+			service = route.service
+			break
+		}
+	}
+	listener.mutex.RUnlock()
+
+	if service == nil || service.tlsConfig == nil {
+		return nil, fmt.Errorf("no tls service on port %d for %q", listener.port, hello.ServerName)
+	}
+	return service.tlsConfig, nil
+}
+
+// splitServerName server_name 里可以带路径，如 example.com/admin，只处理这个路径前缀下的请求
+func splitServerName(serverName string) (string, string) {
+	if strings.HasPrefix(serverName, "~") {
+		return serverName, ""
+	}
+	host, path, found := strings.Cut(serverName, "/")
+	if !found || path == "" {
+		return host, ""
+	}
+	return host, "/" + path
+}
+
+// serverNames 配置里逗号分隔的多个域名
+func (service *Service) serverNames() []string {
+	var names []string
+	for _, serverName := range strings.Split(service.Data.ServerName, ",") {
+		if serverName = strings.TrimSpace(serverName); serverName != "" {
+			names = append(names, serverName)
+		}
+	}
+	return names
+}
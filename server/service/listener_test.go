@@ -0,0 +1,137 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"testing"
+)
+
+// testListener 不监听端口的 portListener，只用来测试路由的排序和匹配
+func testListener() *portListener {
+	return &portListener{hostOrders: make(map[string]int)}
+}
+
+// testHandler 返回注册时的名字，用来判断请求交给了哪条路由
+func testHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name+" "+r.URL.Path)
+	}
+}
+
+func TestListenerHostOrder(t *testing.T) {
+	listener := testListener()
+	service := &Service{Name: "test"}
+	noRules := []*routeRule{nil}
+	listener.handle(`~^.*\.example\.com$`, service, noRules, testHandler("regex"))
+	listener.handle("www.example.*", service, noRules, testHandler("trailing"))
+	listener.handle("*.example.com", service, noRules, testHandler("leading"))
+	listener.handle("*.api.example.com", service, noRules, testHandler("longer leading"))
+	listener.handle("www.example.com", service, noRules, testHandler("exact"))
+	listener.handleDefault(service, noRules, testHandler("default"))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.example.com", "exact"},
+		{"WWW.Example.com.:8080", "exact"},
+		{"v1.api.example.com", "longer leading"},
+		{"shop.example.com", "leading"},
+		{"www.example.net", "trailing"},
+		{"other.org", "default"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		listener.ServeHTTP(w, r)
+		if got := w.Body.String(); got != test.want+" /" {
+			t.Errorf("host %s: got %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestListenerRouteOrder(t *testing.T) {
+	listener := testListener()
+	add := func(name string, route config.RouteConfig) {
+		service := &Service{Name: name, Data: validatedData(t, config.ServiceData{Routes: []config.RouteConfig{route}})}
+		listener.handle("example.com", service, service.compileRoutes(), testHandler(name))
+	}
+	//注册顺序和期望的顺序相反，结果只取决于排序规则
+	add("regex", config.RouteConfig{PathRegex: `^/api/v\d+/`})
+	add("short prefix", config.RouteConfig{PathPrefix: "/api"})
+	add("long prefix", config.RouteConfig{PathPrefix: "/api/v1"})
+	add("exact", config.RouteConfig{Path: "/api/v1/health"})
+	add("priority", config.RouteConfig{PathPrefix: "/api/v1/admin", Priority: 10, Methods: []string{"POST"}})
+	add("strip", config.RouteConfig{PathPrefix: "/static", StripPrefix: true})
+	fallback := &Service{Name: "fallback"}
+	listener.handle("example.com", fallback, fallback.compileRoutes(), testHandler("fallback"))
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/api/v1/health", "exact /api/v1/health"},
+		{"GET", "/api/v1/users", "long prefix /api/v1/users"},
+		{"GET", "/api/v2/users", "short prefix /api/v2/users"},
+		{"POST", "/api/v1/admin/x", "priority /api/v1/admin/x"},
+		{"GET", "/api/v1/admin/x", "long prefix /api/v1/admin/x"},
+		{"GET", "/static/app.js", "strip /app.js"},
+		{"GET", "/other", "fallback /other"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		listener.ServeHTTP(w, r)
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestListenerNotFound(t *testing.T) {
+	listener := testListener()
+	service := &Service{Name: "test", Data: config.ServiceData{Routes: []config.RouteConfig{{PathPrefix: "/api"}}}}
+	listener.handle("example.com", service, service.compileRoutes(), testHandler("api"))
+
+	tests := []struct {
+		host string
+		path string
+	}{
+		{"example.com", "/web"},
+		{"other.com", "/api"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		listener.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s%s: status %d, want 404", test.host, test.path, w.Code)
+		}
+	}
+}
+
+func TestSplitServerName(t *testing.T) {
+	tests := []struct {
+		serverName string
+		wantHost   string
+		wantPath   string
+	}{
+		{"example.com", "example.com", ""},
+		{"example.com/", "example.com", ""},
+		{"example.com/admin", "example.com", "/admin"},
+		{"example.com/admin/api", "example.com", "/admin/api"},
+		{`~^(a|b)/c$`, `~^(a|b)/c$`, ""},
+	}
+	for _, test := range tests {
+		host, path := splitServerName(test.serverName)
+		if host != test.wantHost || path != test.wantPath {
+			t.Errorf("splitServerName(%q) = %q, %q, want %q, %q", test.serverName, host, path, test.wantHost, test.wantPath)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	longConnWebSocket = "websocket"
+	longConnSse       = "sse"
+)
+
+// websocketGoingAway 服务端发给客户端的关闭帧，状态码 1001 Going Away，服务端的帧不需要掩码
+var websocketGoingAway = []byte{0x88, 0x02, 0x03, 0xe9}
+
+// longConn 实例上的一个长连接（升级后的 WebSocket 连接或 SSE 响应）
+type longConn struct {
+	kind   string
+	cancel context.CancelFunc //取消请求的 context，ReverseProxy 会结束转发并关闭连接
+	conn   *trackedConn       //WebSocket 被 Hijack 后的客户端连接，SSE 为 nil
+}
+
+// trackedConn 包装 Hijack 出来的客户端连接，关闭前可以先发送 WebSocket 关闭帧
+type trackedConn struct {
+	net.Conn
+	writeMutex sync.Mutex
+	closeFrame bool
+	closeOnce  sync.Once
+}
+
+func (conn *trackedConn) Write(data []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	return conn.Conn.Write(data)
+}
+
+func (conn *trackedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.writeMutex.Lock()
+		defer conn.writeMutex.Unlock()
+		if conn.closeFrame {
+			_ = conn.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_, _ = conn.Conn.Write(websocketGoingAway)
+		}
+	})
+	return conn.Conn.Close()
+}
+
+// goingAway 标记关闭时发送关闭帧，在真正关闭前调用
+func (conn *trackedConn) goingAway() {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	conn.closeFrame = true
+}
+
+// Hijack 升级连接时 ReverseProxy 通过 http.ResponseController 调用，记下客户端连接以便重启实例时关闭
+func (recorder *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, readWriter, err := http.NewResponseController(recorder.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	recorder.status = http.StatusSwitchingProtocols
+	if recorder.onHijack != nil {
+		conn = recorder.onHijack(conn)
+	}
+	return conn, readWriter, nil
+}
+
+// isEventStream 响应是不是 SSE
+func isEventStream(res *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// trackLongConn 实例返回了升级或 SSE 响应时登记长连接，请求结束时由 handleRequest 注销
+// 长连接可能保持几个小时，登记后马上释放它占用的并发位置，否则 max_per_instance 个长连接就会占满实例
+func (service *Service) trackLongConn(pc *proxyContext, res *http.Response) {
+	kind := ""
+	switch {
+	case res.StatusCode == http.StatusSwitchingProtocols:
+		kind = longConnWebSocket
+	case isEventStream(res):
+		kind = longConnSse
+	default:
+		return
+	}
+
+	lc := &longConn{kind: kind, cancel: pc.cancel}
+	instance := pc.instance
+	instance.longMutex.Lock()
+	if instance.longConns == nil {
+		instance.longConns = make(map[*longConn]struct{})
+	}
+	instance.longConns[lc] = struct{}{}
+	instance.longMutex.Unlock()
+	pc.longConn = lc
+	pc.longInstance = instance
+	longConnections.Inc(service.Name, strconv.Itoa(instance.Port), kind)
+	service.releaseSlots(pc)
+}
+
+func (service *Service) untrackLongConn(pc *proxyContext) {
+	lc, instance := pc.longConn, pc.longInstance
+	if lc == nil {
+		return
+	}
+	instance.longMutex.Lock()
+	delete(instance.longConns, lc)
+	instance.longMutex.Unlock()
+	longConnections.Dec(service.Name, strconv.Itoa(instance.Port), lc.kind)
+}
+
+// attachConn Hijack 出来的客户端连接挂到当前请求登记的长连接上
+func (pc *proxyContext) attachConn(conn net.Conn) net.Conn {
+	tracked := &trackedConn{Conn: conn}
+	if pc.longConn != nil {
+		pc.longInstance.longMutex.Lock()
+		pc.longConn.conn = tracked
+		pc.longInstance.longMutex.Unlock()
+	}
+	return tracked
+}
+
+func (instance *Instance) longConnCount() int {
+	instance.longMutex.Lock()
+	defer instance.longMutex.Unlock()
+	return len(instance.longConns)
+}
+
+// drainLongConns 停止实例前等待实例上的长连接结束，超过 drain_timeout 后关闭剩下的连接
+func (service *Service) drainLongConns(instance *Instance) {
+	drainTimeout := time.Duration(service.Data.LongConnections.DrainTimeout) * time.Second
+	if drainTimeout <= 0 || instance.longConnCount() == 0 {
+		return
+	}
+
+	log.Info("waiting for long connections to finish", zap.String("service", service.Name),
+		zap.Int("port", instance.Port), zap.Int("connections", instance.longConnCount()), zap.Duration("timeout", drainTimeout))
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) && instance.longConnCount() > 0 {
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	instance.longMutex.Lock()
+	remaining := make([]*longConn, 0, len(instance.longConns))
+	for lc := range instance.longConns {
+		remaining = append(remaining, lc)
+	}
+	instance.longMutex.Unlock()
+	if len(remaining) == 0 {
+		return
+	}
+
+	log.Info("close long connections after drain timeout", zap.String("service", service.Name),
+		zap.Int("port", instance.Port), zap.Int("connections", len(remaining)))
+	for _, lc := range remaining {
+		instance.longMutex.Lock()
+		conn := lc.conn
+		instance.longMutex.Unlock()
+		if conn != nil && service.Data.LongConnections.CloseFrame {
+			conn.goingAway()
+		}
+		lc.cancel()
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"testing"
+	"time"
+)
+
+// websocketUpstream 升级后原样返回收到的数据的实例
+func websocketUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, readWriter, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = readWriter.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = readWriter.Flush()
+		_, _ = io.Copy(conn, readWriter)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// dialWebSocket 通过服务建立一个升级后的连接
+func dialWebSocket(t *testing.T, front *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_, _ = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status = %d", res.StatusCode)
+	}
+	return conn, reader
+}
+
+func waitLongConns(t *testing.T, instance *Instance, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if instance.longConnCount() == n {
+			return
+		}
+	}
+	t.Fatalf("instance has %d long connections, want %d", instance.longConnCount(), n)
+}
+
+func TestWebSocketDrain(t *testing.T) {
+	data := config.ServiceData{
+		Concurrency:     config.ConcurrencyConfig{MaxPerInstance: 1},
+		LongConnections: config.LongConnectionConfig{DrainTimeout: 1, CloseFrame: true},
+	}
+	service := newTestService(t, data, websocketUpstream(t))
+	front := httptest.NewServer(http.HandlerFunc(service.handleRequest))
+	defer front.Close()
+	instance := service.Instances()[0]
+
+	conn, reader := dialWebSocket(t, front)
+	_, _ = conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+	waitLongConns(t, instance, 1)
+	//长连接不占用并发位置，实例还可以处理新的请求
+	if active := instance.activeRequests.Load(); active != 0 {
+		t.Errorf("websocket holds %d instance slots", active)
+	}
+
+	start := time.Now()
+	service.drainLongConns(instance)
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("drain returned after %s, before drain_timeout", elapsed)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != string(websocketGoingAway) {
+		t.Errorf("client got %x before the close, want the going away frame %x", rest, websocketGoingAway)
+	}
+	waitLongConns(t, instance, 0)
+}
+
+// TestDrainFinishesEarly 长连接在 drain_timeout 之前自己结束时不用等到超时
+func TestDrainFinishesEarly(t *testing.T) {
+	service := newTestService(t, config.ServiceData{LongConnections: config.LongConnectionConfig{DrainTimeout: 5}}, websocketUpstream(t))
+	front := httptest.NewServer(http.HandlerFunc(service.handleRequest))
+	defer front.Close()
+	instance := service.Instances()[0]
+
+	conn, _ := dialWebSocket(t, front)
+	waitLongConns(t, instance, 1)
+	time.AfterFunc(100*time.Millisecond, func() { _ = conn.Close() })
+	start := time.Now()
+	service.drainLongConns(instance)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("drain took %s after the connection was closed", elapsed)
+	}
+}
+
+func TestServerSentEventsDrain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		_, _ = w.Write([]byte("data: hello\n\n"))
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	service := newTestService(t, config.ServiceData{LongConnections: config.LongConnectionConfig{DrainTimeout: 1}}, upstream)
+	front := httptest.NewServer(http.HandlerFunc(service.handleRequest))
+	defer front.Close()
+	instance := service.Instances()[0]
+
+	res, err := http.Get(front.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+	if line, _ := reader.ReadString('\n'); line != "data: hello\n" {
+		t.Fatalf("first event = %q", line)
+	}
+	waitLongConns(t, instance, 1)
+
+	go service.drainLongConns(instance)
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("event stream is still open after the drain timeout")
+	}
+	waitLongConns(t, instance, 0)
+}
+
+func TestIsEventStream(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"text/event-stream":                true,
+		"Text/Event-Stream; charset=utf-8": true,
+		"text/html":                        false,
+		"":                                 false,
+	} {
+		res := &http.Response{Header: http.Header{"Content-Type": {contentType}}}
+		if got := isEventStream(res); got != want {
+			t.Errorf("isEventStream(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
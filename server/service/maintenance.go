@@ -0,0 +1,61 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maintenanceInstance 维护模式下直接返回的请求在指标里的 instance 标签
+	maintenanceInstance = "maintenance"
+	maintenanceMessage  = "Service under maintenance"
+)
+
+// SetMaintenance 开启或关闭维护模式，实例继续运行，只是请求不再转发给它们（允许的 IP 除外）
+func (service *Service) SetMaintenance(on bool) {
+	service.maintenance.Store(on)
+	value := 0.0
+	if on {
+		value = 1
+	}
+	maintenanceMode.Set(value, service.Name)
+}
+
+// InMaintenance 是否处于维护模式
+func (service *Service) InMaintenance() bool {
+	return service.maintenance.Load()
+}
+
+// maintenanceAllowed 维护时仍然可以访问实例的客户端，如运维自己的 IP
+func (service *Service) maintenanceAllowed(r *http.Request) bool {
+	return containsIp(service.maintenanceAllow, net.ParseIP(service.clientIp(r)))
+}
+
+// serveMaintenance 处于维护模式时返回维护页，返回 true 表示请求已经处理完
+func (service *Service) serveMaintenance(w http.ResponseWriter, r *http.Request, requestId string) bool {
+	if !service.InMaintenance() || service.maintenanceAllowed(r) {
+		return false
+	}
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+	maintenance := service.Data.Maintenance
+	if maintenance.RetryAfter > 0 {
+		recorder.Header().Set("Retry-After", strconv.Itoa(maintenance.RetryAfter))
+	}
+
+	//没有单独配置维护页时使用 503 的错误页
+	htmlFile, jsonFile := maintenance.Html, maintenance.Json
+	if htmlFile == "" {
+		htmlFile = service.Data.ErrorPages.Html[http.StatusServiceUnavailable]
+	}
+	if jsonFile == "" {
+		jsonFile = service.Data.ErrorPages.Json[http.StatusServiceUnavailable]
+	}
+	service.writeErrorWith(recorder, r, http.StatusServiceUnavailable, maintenanceMessage, requestId, htmlFile, jsonFile)
+
+	requestsTotal.Inc(service.Name, maintenanceInstance, statusClass(http.StatusServiceUnavailable))
+	service.accessLog.Log(service.newAccessEntry(r, recorder, start, requestId))
+	return true
+}
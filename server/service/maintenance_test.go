@@ -0,0 +1,73 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "from instance")
+	}))
+	defer upstream.Close()
+	service := newTestService(t, config.ServiceData{Maintenance: config.MaintenanceConfig{
+		Enabled:    true,
+		Allow:      []string{"10.0.0.0/8"},
+		RetryAfter: 120,
+	}}, upstream)
+	if !service.InMaintenance() {
+		t.Fatal("maintenance.enabled should start the service in maintenance mode")
+	}
+
+	closed := serve(service, httptest.NewRequest(http.MethodGet, "/", nil))
+	if closed.Code != http.StatusServiceUnavailable || !strings.Contains(closed.Body.String(), maintenanceMessage) {
+		t.Errorf("in maintenance = %d %q, want 503", closed.Code, closed.Body.String())
+	}
+	if closed.Header().Get("Retry-After") != "120" {
+		t.Errorf("Retry-After = %q, want 120", closed.Header().Get("Retry-After"))
+	}
+
+	//允许的 IP 照常访问实例
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	if allowed := serve(service, r); allowed.Code != http.StatusOK || allowed.Body.String() != "from instance" {
+		t.Errorf("allowed ip = %d %q, want the instance response", allowed.Code, allowed.Body.String())
+	}
+
+	service.SetMaintenance(false)
+	if open := serve(service, httptest.NewRequest(http.MethodGet, "/", nil)); open.Code != http.StatusOK {
+		t.Errorf("after maintenance off = %d, want 200", open.Code)
+	}
+	service.SetMaintenance(true)
+	if serve(service, httptest.NewRequest(http.MethodGet, "/", nil)).Code != http.StatusServiceUnavailable {
+		t.Error("maintenance on again should return 503")
+	}
+}
+
+func TestMaintenancePage(t *testing.T) {
+	dir := t.TempDir()
+	writePage(t, filepath.Join(dir, "503.html"), "<p>503 page</p>")
+	writePage(t, filepath.Join(dir, "maintenance.html"), "<p>{{.Service}} is being upgraded</p>")
+	data := config.ServiceData{
+		ExecutablePath: filepath.Join(dir, "app"),
+		ErrorPages:     config.ErrorPagesConfig{Html: map[int]string{http.StatusServiceUnavailable: "503.html"}},
+		Maintenance:    config.MaintenanceConfig{Enabled: true},
+	}
+
+	//没有单独的维护页时使用 503 的错误页
+	service := newTestService(t, data)
+	if body := serve(service, httptest.NewRequest(http.MethodGet, "/", nil)).Body.String(); body != "<p>503 page</p>" {
+		t.Errorf("body = %q, want the 503 error page", body)
+	}
+
+	data.Maintenance.Html = "maintenance.html"
+	service = newTestService(t, data)
+	if body := serve(service, httptest.NewRequest(http.MethodGet, "/", nil)).Body.String(); body != "<p>test is being upgraded</p>" {
+		t.Errorf("body = %q, want the maintenance page", body)
+	}
+}
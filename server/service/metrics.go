@@ -0,0 +1,109 @@
+package service
+
+import (
+	"os"
+	"smoothserver/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	requestsTotal    = metrics.NewCounterVec("smoothserve_requests_total", "Proxied requests by service, instance port and status class.", "service", "instance", "code")
+	requestDuration  = metrics.NewHistogramVec("smoothserve_request_duration_seconds", "Latency of proxied requests.", metrics.DefaultBuckets, "service", "instance")
+	requestsInFlight = metrics.NewGaugeVec("smoothserve_requests_in_flight", "Requests currently being proxied.", "service", "instance")
+	longConnections  = metrics.NewGaugeVec("smoothserve_long_connections", "Open WebSocket and SSE connections, counted apart from ordinary requests.", "service", "instance", "kind")
+	instanceState    = metrics.NewGaugeVec("smoothserve_instance_state", "Current state of each instance, 1 for the active state.", "service", "instance", "state")
+	instanceRestarts = metrics.NewCounterVec("smoothserve_instance_restarts_total", "Instance restarts done by smoothserve.", "service", "instance")
+	instanceCrashes  = metrics.NewCounterVec("smoothserve_instance_crashes_total", "Instances that exited without being stopped.", "service", "instance")
+	upstreamRetries  = metrics.NewCounterVec("smoothserve_upstream_retries_total", "Requests retried on another instance, by the instance that failed and the reason.", "service", "instance", "reason")
+	queueWaiting     = metrics.NewGaugeVec("smoothserve_queue_waiting", "Requests waiting in the queue for an instance.", "service")
+	queueRejected    = metrics.NewCounterVec("smoothserve_queue_rejected_total", "Requests that could not wait for an instance, because the queue was full or the wait timed out.", "service", "reason")
+	limitRejected    = metrics.NewCounterVec("smoothserve_limit_rejected_total", "Requests rejected by rate limits and concurrency caps, by reason.", "service", "reason")
+	accessDenied     = metrics.NewCounterVec("smoothserve_access_denied_total", "Requests rejected by IP allow/deny lists and basic auth, by reason.", "service", "reason")
+	rolloutDuration  = metrics.NewHistogramVec("smoothserve_rollout_duration_seconds", "Duration of rolling restarts of a whole service.", []float64{1, 5, 10, 30, 60, 120, 300, 600}, "service")
+	maintenanceMode  = metrics.NewGaugeVec("smoothserve_maintenance", "1 while the service is in maintenance mode.", "service")
+	instanceRss      = metrics.NewGaugeVec("smoothserve_instance_resident_memory_bytes", "Resident memory of the instance process, read from /proc.", "service", "instance")
+	instanceCpu      = metrics.NewGaugeVec("smoothserve_instance_cpu_seconds", "User and system CPU time of the instance process, read from /proc.", "service", "instance")
+)
+
+var statusNames = map[int32]string{
+	StatusNone:        "none",
+	StatusStopped:     "stopped",
+	StatusStopping:    "stopping",
+	StatusWillRunning: "starting",
+	StatusWaitingStop: "waiting_stop",
+	StatusRunning:     "running",
+}
+
+// clockTicks /proc/<pid>/stat 里 cpu 时间的单位，Linux 上基本都是 100
+const clockTicks = 100
+
+// statusClass 把状态码归为 2xx、5xx 这样的类别
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// CollectMetrics 刷新实例状态和进程资源的指标，在输出 /metrics 前调用
+func (service *Service) CollectMetrics() {
+	for _, instance := range service.Instances() {
+		if instance == nil {
+			continue
+		}
+		port := strconv.Itoa(instance.Port)
+		for status, name := range statusNames {
+			value := 0.0
+			if instance.Status.Load() == status {
+				value = 1
+			}
+			instanceState.Set(value, service.Name, port, name)
+		}
+
+		rss, cpu, ok := readProcessStats(instance.Pid())
+		if !ok {
+			instanceRss.Delete(service.Name, port)
+			instanceCpu.Delete(service.Name, port)
+			continue
+		}
+		instanceRss.Set(float64(rss), service.Name, port)
+		instanceCpu.Set(cpu, service.Name, port)
+	}
+}
+
+// readProcessStats 从 /proc 读取进程的常驻内存（字节）和 cpu 时间（秒）
+func readProcessStats(pid string) (rss int64, cpu float64, ok bool) {
+	statm, err := os.ReadFile("/proc/" + pid + "/statm")
+	if err != nil {
+		return 0, 0, false
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	rss = pages * int64(os.Getpagesize())
+
+	stat, err := os.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	//进程名里可能有空格，从最后一个 ) 之后开始解析，utime 和 stime 是其后的第12、13个字段
+	content := string(stat)
+	fields = strings.Fields(content[strings.LastIndex(content, ")")+1:])
+	if len(fields) < 13 {
+		return 0, 0, false
+	}
+	utime, _ := strconv.ParseFloat(fields[11], 64)
+	stime, _ := strconv.ParseFloat(fields[12], 64)
+	return rss, (utime + stime) / clockTicks, true
+}
+
+func observeRollout(service *Service, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	rolloutDuration.Observe(time.Since(start).Seconds(), service.Name)
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"smoothserver/metrics"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusClass(t *testing.T) {
+	for status, want := range map[int]string{200: "2xx", 204: "2xx", 302: "3xx", 404: "4xx", 503: "5xx"} {
+		if got := statusClass(status); got != want {
+			t.Errorf("statusClass(%d) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestReadProcessStats(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	//烧一点 cpu，保证 cpu 时间大于 0
+	for start := time.Now(); time.Since(start) < 50*time.Millisecond; {
+	}
+	rss, cpu, ok := readProcessStats(strconv.Itoa(os.Getpid()))
+	if !ok || rss <= 0 || cpu <= 0 {
+		t.Errorf("readProcessStats(self) = %d, %f, %v", rss, cpu, ok)
+	}
+	if _, _, ok = readProcessStats("0"); ok {
+		t.Error("readProcessStats() of a missing process is ok")
+	}
+}
+
+func TestCollectMetrics(t *testing.T) {
+	running := newInstance(strconv.Itoa(os.Getpid()), 9101)
+	running.Status.Store(StatusRunning)
+	stopped := newInstance("0", 9102)
+	stopped.Status.Store(StatusStopped)
+	service := &Service{Name: "metrics-test"}
+	service.storeInstances([]*Instance{running, nil, stopped})
+
+	w := httptest.NewRecorder()
+	metrics.Handler(service.CollectMetrics).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	output := w.Body.String()
+	for _, want := range []string{
+		`smoothserve_instance_state{service="metrics-test",instance="9101",state="running"} 1`,
+		`smoothserve_instance_state{service="metrics-test",instance="9101",state="stopped"} 0`,
+		`smoothserve_instance_state{service="metrics-test",instance="9102",state="stopped"} 1`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output does not contain %s", want)
+		}
+	}
+	//进程不存在的实例没有资源指标
+	if strings.Contains(output, `smoothserve_instance_resident_memory_bytes{service="metrics-test",instance="9102"}`) {
+		t.Error("stopped instance has a memory metric")
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(output, `smoothserve_instance_cpu_seconds{service="metrics-test",instance="9101"}`) {
+		t.Error("running instance has no cpu metric")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !unix
+
+package service
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func useLauncher(cmd *exec.Cmd, umask string, wait bool) (*os.File, error) {
+	if umask != "" {
+		return nil, errors.New("umask is only supported on unix")
+	}
+	return nil, nil
+}
+
+func releaseLauncher(cmd *exec.Cmd, ready *os.File, ok bool) {
+}
+
+func terminateGroup(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+func sweepGroup(pid int, timeout time.Duration) bool {
+	return false
+}
@@ -0,0 +1,107 @@
+//go:build unix
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// launcherScript 在实例进程里先做好准备再 exec 真正的可执行文件，exec 之后 pid 不变，进程组和 cgroup 照常生效
+// $0 是 umask，为空时不修改；$1 为 wait 时先等 smoothserve 设置好 rlimit，从 fd 3 读到一行后再继续，管道被关闭时退出
+// umask 是整个进程共享的，不能在 smoothserve 里临时修改，否则同一时间其它 goroutine 创建的文件（如访问日志、证书）权限会不对
+const launcherScript = `[ -z "$0" ] || umask "$0" || exit 126
+if [ "$1" = wait ]; then read -r ready <&3 || exit 126; exec 3<&-; fi
+shift
+exec "$@"`
+
+// useLauncher 配置了 umask 或者需要在实例代码运行前设置 rlimit 时通过 /bin/sh 启动实例
+// 需要等待时返回管道的写端，设置好 rlimit 后调用 releaseLauncher
+func useLauncher(cmd *exec.Cmd, umask string, wait bool) (*os.File, error) {
+	if umask == "" && !wait {
+		return nil, nil
+	}
+	if umask != "" {
+		if _, err := strconv.ParseUint(umask, 8, 32); err != nil {
+			return nil, fmt.Errorf("invalid umask %q: %w", umask, err)
+		}
+	}
+	mode := ""
+	var ready *os.File
+	if wait {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		cmd.ExtraFiles = []*os.File{reader}
+		ready = writer
+		mode = "wait"
+	}
+	cmd.Args = append([]string{"/bin/sh", "-c", launcherScript, umask, mode, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	return ready, nil
+}
+
+// releaseLauncher 让等待中的实例继续 exec；ok 为 false 时只关闭管道，实例直接退出
+func releaseLauncher(cmd *exec.Cmd, ready *os.File, ok bool) {
+	if ready == nil {
+		return
+	}
+	for _, file := range cmd.ExtraFiles {
+		_ = file.Close()
+	}
+	if ok {
+		_, _ = ready.WriteString("\n")
+	}
+	_ = ready.Close()
+}
+
+// setProcessGroup 让实例在自己的进程组里启动，停止时可以连同它 fork 出来的子进程一起停止
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateGroup 给实例所在的进程组发送 SIGTERM，进程组 id 就是实例的 pid
+func terminateGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// groupAlive 进程组里是否还有进程
+func groupAlive(pid int) bool {
+	err := syscall.Kill(-pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// sweepGroup 实例主进程退出后，确认进程组里没有残留的进程再复用端口
+// 还有残留时先发送 SIGTERM，超时后发送 SIGKILL，返回被清理的进程组里是否有残留
+func sweepGroup(pid int, timeout time.Duration) bool {
+	if !groupAlive(pid) {
+		return false
+	}
+	_ = syscall.Kill(-pid, syscall.SIGTERM)
+	if waitGroupExit(pid, timeout) {
+		return true
+	}
+	_ = syscall.Kill(-pid, syscall.SIGKILL)
+	waitGroupExit(pid, timeout)
+	return true
+}
+
+func waitGroupExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !groupAlive(pid) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return !groupAlive(pid)
+}
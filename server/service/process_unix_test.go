@@ -0,0 +1,111 @@
+//go:build unix
+
+package service
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLauncherUmask(t *testing.T) {
+	tests := []struct {
+		umask   string
+		want    string
+		wantErr bool
+	}{
+		{umask: "027", want: "0027"},
+		{umask: "0077", want: "0077"},
+		{umask: "8", wantErr: true},
+	}
+	for _, test := range tests {
+		cmd := exec.Command("/bin/sh", "-c", "umask")
+		ready, err := useLauncher(cmd, test.umask, false)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("useLauncher(%q) accepted an invalid umask", test.umask)
+			}
+			continue
+		}
+		if err != nil || ready != nil {
+			t.Fatalf("useLauncher(%q) = %v, %v", test.umask, ready, err)
+		}
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(output)); got != test.want {
+			t.Errorf("umask %q: instance sees %s, want %s", test.umask, got, test.want)
+		}
+	}
+
+	//没有 umask 也不用等待时直接启动，不经过 /bin/sh
+	cmd := exec.Command("/bin/true")
+	if ready, err := useLauncher(cmd, "", false); ready != nil || err != nil || cmd.Path != "/bin/true" {
+		t.Errorf("useLauncher() without umask changed the command to %s %v", cmd.Path, cmd.Args)
+	}
+}
+
+func startGroup(t *testing.T, script string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	return cmd
+}
+
+func TestTerminateGroup(t *testing.T) {
+	//实例 fork 出来的子进程也在同一个进程组里，一起收到 SIGTERM
+	marker := filepath.Join(t.TempDir(), "child-terminated")
+	cmd := startGroup(t, `(trap "echo term > `+marker+`; exit 0" TERM; sleep 60 & wait) & wait`)
+	pid := cmd.Process.Pid
+	time.Sleep(200 * time.Millisecond)
+	if !groupAlive(pid) {
+		t.Fatal("process group is not alive after start")
+	}
+	if err := terminateGroup(pid); err != nil {
+		t.Fatal(err)
+	}
+	_ = cmd.Wait()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(marker); err == nil {
+			return
+		}
+	}
+	t.Error("child process did not get SIGTERM sent to the group")
+}
+
+func TestSweepGroup(t *testing.T) {
+	//主进程退出了，留下一个忽略 SIGTERM 的子进程，超时后被 SIGKILL 清理
+	cmd := startGroup(t, `(trap "" TERM; sleep 60) & exit 0`)
+	pid := cmd.Process.Pid
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	//进程组已经被杀掉，僵尸进程要等 init 回收，所以这里不再检查 groupAlive
+	start := time.Now()
+	if !sweepGroup(pid, 300*time.Millisecond) {
+		t.Error("sweepGroup() found no leftover process")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("sweepGroup() returned after %s, SIGTERM should have been ignored until the timeout", elapsed)
+	}
+
+	//没有残留时直接返回
+	cmd = startGroup(t, "exit 0")
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if sweepGroup(cmd.Process.Pid, time.Second) {
+		t.Error("sweepGroup() reported leftovers for a clean exit")
+	}
+}
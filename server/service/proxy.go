@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"smoothserver/config"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxIdleConnsPerInstance = 32
+	defaultIdleConnTimeout         = 90
+	defaultDialTimeout             = 5
+	defaultBufferSize              = 32 * 1024
+)
+
+// proxyContextKey 通过请求的 context 把这次请求选中的实例等信息传给共用的 ReverseProxy
+type proxyContextKey struct{}
+
+type proxyContext struct {
+	in          *http.Request //客户端的原始请求
+	instance    *Instance     //处理请求的实例，重试时会换成新的实例
+	upstreamPid string
+	upstream    string //实例的地址 ip:port
+	requestId   string
+	retries     int //换实例重试的次数
+
+	slotsReleased bool //并发上限占用的位置已经释放，长连接建立后提前释放
+
+	cancel       context.CancelFunc //取消这次请求，重启实例时用来关闭长连接
+	longConn     *longConn          //响应是 WebSocket 升级或 SSE 时登记的长连接
+	longInstance *Instance          //长连接所在的实例
+}
+
+func withProxyContext(r *http.Request, pc *proxyContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, pc))
+}
+
+func getProxyContext(r *http.Request) *proxyContext {
+	pc, _ := r.Context().Value(proxyContextKey{}).(*proxyContext)
+	return pc
+}
+
+// bufferPool 复制响应体时复用缓冲区
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() any {
+		return make([]byte, size)
+	}}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	p.pool.Put(buf)
+}
+
+// newTransport 按配置创建连接实例用的 Transport，同一个服务的所有请求共用，保持长连接
+// h2c 和 h2 时一个实例只需要少量连接，请求在连接上多路复用
+func (service *Service) newTransport() http.RoundTripper {
+	upstream := service.Data.Upstream
+
+	maxIdlePerInstance := upstream.MaxIdleConnsPerInstance
+	if maxIdlePerInstance <= 0 {
+		maxIdlePerInstance = defaultMaxIdleConnsPerInstance
+	}
+	idleTimeout := upstream.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleConnTimeout
+	}
+	dialTimeout := upstream.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(dialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if upstream.Protocol == config.ProtocolH2c {
+		//disable_keep_alive 在配置检查时已经拒绝了，h2c 总是复用连接
+		return newH2cTransport(&http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				//明文连接，不做 TLS 握手
+				return dialer.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: 30 * time.Second, //连接上一段时间没有数据时发 ping 检查实例是否还在
+			PingTimeout:     5 * time.Second,
+		}, time.Duration(idleTimeout)*time.Second, time.Duration(upstream.ResponseHeaderTimeout)*time.Second)
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		DisableKeepAlives:     upstream.DisableKeepAlive,
+		MaxIdleConns:          maxIdlePerInstance * max(service.Data.InstanceCount, 1),
+		MaxIdleConnsPerHost:   maxIdlePerInstance, //每个实例是一个 host
+		IdleConnTimeout:       time.Duration(idleTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(upstream.ResponseHeaderTimeout) * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if upstream.Protocol == config.ProtocolH2 {
+		serverName := upstream.TlsServerName
+		if serverName == "" {
+			serverName = service.Data.ServerIp
+		}
+		transport.TLSClientConfig = &tls.Config{ServerName: serverName, InsecureSkipVerify: upstream.InsecureSkipVerify}
+		//自定义了 DialContext 时需要显式开启 HTTP/2
+		transport.ForceAttemptHTTP2 = true
+	}
+	return transport
+}
+
+// errResponseHeaderTimeout 实例在 response_header_timeout 内没有返回响应头
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// h2cTransport 给 http2.Transport 补上 idle_conn_timeout 和 response_header_timeout，
+// 单独使用的 http2.Transport 不读取这两个设置
+type h2cTransport struct {
+	transport     *http2.Transport
+	headerTimeout time.Duration //0 表示不限制
+	// idleTimer 所有连接都没有新请求、响应体也都关闭了 idle_conn_timeout 之后关闭空闲连接，
+	// 有请求正在进行的连接不会被关闭；h2c 到每个实例通常只有一条连接，这样和按连接计时差不多
+	idleTimer   *time.Timer
+	idleTimeout time.Duration
+}
+
+func newH2cTransport(transport *http2.Transport, idleTimeout time.Duration, headerTimeout time.Duration) *h2cTransport {
+	t := &h2cTransport{transport: transport, headerTimeout: headerTimeout, idleTimeout: idleTimeout}
+	t.idleTimer = time.AfterFunc(idleTimeout, transport.CloseIdleConnections)
+	return t
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.idleTimer.Reset(t.idleTimeout)
+	if t.headerTimeout <= 0 {
+		res, err := t.transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = &closeNotifyBody{ReadCloser: res.Body, closed: t.closed}
+		return res, nil
+	}
+
+	//只限制等待响应头的时间，收到响应头后不再计时，流式响应和 gRPC 的长流不受影响
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.headerTimeout, func() {
+		cancel(errResponseHeaderTimeout)
+	})
+	res, err := t.transport.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		timedOut := errors.Is(context.Cause(ctx), errResponseHeaderTimeout)
+		cancel(nil)
+		if timedOut {
+			//按超时处理，ErrorHandler 返回 504
+			return nil, fmt.Errorf("%w: %w", errResponseHeaderTimeout, context.DeadlineExceeded)
+		}
+		return nil, err
+	}
+	//响应体关闭时再释放 context，提前取消会中断响应体
+	res.Body = &closeNotifyBody{ReadCloser: res.Body, closed: func() {
+		cancel(nil)
+		t.closed()
+	}}
+	return res, nil
+}
+
+// closed 响应体关闭后重新开始空闲计时
+func (t *h2cTransport) closed() {
+	t.idleTimer.Reset(t.idleTimeout)
+}
+
+func (t *h2cTransport) CloseIdleConnections() {
+	t.transport.CloseIdleConnections()
+}
+
+// closeNotifyBody 响应体关闭时回调
+type closeNotifyBody struct {
+	io.ReadCloser
+	closed func()
+	once   sync.Once
+}
+
+func (body *closeNotifyBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.closed)
+	return err
+}
+
+// upstreamScheme 转发给实例的请求使用的 scheme
+func (service *Service) upstreamScheme() string {
+	if service.Data.Upstream.Protocol == config.ProtocolH2 {
+		return "https"
+	}
+	return "http"
+}
+
+// newReverseProxy 创建服务共用的反向代理，每次请求的实例从 context 里取
+func (service *Service) newReverseProxy() *httputil.ReverseProxy {
+	bufferSize := service.Data.Upstream.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	return &httputil.ReverseProxy{
+		Transport:  &retryTransport{service: service, transport: service.newTransport()},
+		BufferPool: newBufferPool(bufferSize),
+		Director: func(req *http.Request) {
+			pc := getProxyContext(req)
+			req.URL.Scheme = service.upstreamScheme()
+			req.URL.Host = pc.upstream
+			service.setForwardHeaders(pc.in, req)
+			applyHeaderRules(req.Header, service.Data.Rewrite.RequestHeaders)
+			req.Host = service.upstreamHost(pc.in, pc.upstream)
+		},
+		ModifyResponse: func(res *http.Response) error {
+			pc := getProxyContext(res.Request)
+			res.Header.Set(service.requestIdHeader(), pc.requestId)
+			applyHeaderRules(res.Header, service.Data.Rewrite.ResponseHeaders)
+			service.trackLongConn(pc, res)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			pc := getProxyContext(req)
+			log.Error("proxy request failed", zap.String("service", service.Name), zap.Int("port", pc.instance.Port),
+				zap.String("request_id", pc.requestId), zap.Error(err))
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+				service.writeError(w, req, http.StatusGatewayTimeout, "Gateway Timeout", pc.requestId)
+				return
+			}
+			service.writeError(w, req, http.StatusBadGateway, "Bad Gateway", pc.requestId)
+		},
+	}
+}
+
+// upstreamAddr 实例的地址 目前仅支持本地的ip,因为服务启动过的方式就是通过调用本地命令行执行的
+func (service *Service) upstreamAddr(instance *Instance) string {
+	return fmt.Sprintf("%s:%d", service.Data.ServerIp, instance.Port)
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewTransport(t *testing.T) {
+	service := &Service{Name: "test", Data: config.ServiceData{InstanceCount: 3, Upstream: config.UpstreamConfig{
+		MaxIdleConnsPerInstance: 8,
+		IdleConnTimeout:         30,
+		ResponseHeaderTimeout:   5,
+		DisableKeepAlive:        true,
+	}}}
+	transport, ok := service.newTransport().(*http.Transport)
+	if !ok {
+		t.Fatalf("newTransport() is %T, want *http.Transport", service.newTransport())
+	}
+	if transport.MaxIdleConnsPerHost != 8 || transport.MaxIdleConns != 24 || transport.IdleConnTimeout != 30*time.Second ||
+		transport.ResponseHeaderTimeout != 5*time.Second || !transport.DisableKeepAlives {
+		t.Errorf("transport = %+v", transport)
+	}
+
+	defaults := (&Service{Name: "test"}).newTransport().(*http.Transport)
+	if defaults.MaxIdleConnsPerHost != defaultMaxIdleConnsPerInstance || defaults.IdleConnTimeout != defaultIdleConnTimeout*time.Second ||
+		defaults.ResponseHeaderTimeout != 0 || defaults.DisableKeepAlives {
+		t.Errorf("default transport = %+v", defaults)
+	}
+}
+
+// TestProxyReusesConnections 同一个服务的请求共用连接池，顺序的请求只需要一条连接
+func TestProxyReusesConnections(t *testing.T) {
+	var connections atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	service := newTestService(t, config.ServiceData{}, upstream)
+	for i := 0; i < 10; i++ {
+		if w := serve(service, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Fatalf("request %d = %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if got := connections.Load(); got != 1 {
+		t.Errorf("%d connections to the instance, want 1", got)
+	}
+}
+
+func TestProxyResponseHeaderTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(3 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	service := newTestService(t, config.ServiceData{Upstream: config.UpstreamConfig{ResponseHeaderTimeout: 1}}, upstream)
+	if w := serve(service, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", w.Code)
+	}
+}
+
+func TestSelectInstanceRoundRobin(t *testing.T) {
+	service := &Service{Name: "test"}
+	instances := make([]*Instance, 4)
+	for i := range instances {
+		instances[i] = newInstance(strconv.Itoa(i), 8000+i)
+		instances[i].Status.Store(StatusRunning)
+	}
+	instances[2].Status.Store(StatusStopping)
+	service.storeInstances(instances)
+
+	counts := make(map[int]int)
+	for i := 0; i < 300; i++ {
+		counts[service.SelectInstance().Port]++
+	}
+	if counts[8002] != 0 {
+		t.Errorf("stopping instance got %d requests", counts[8002])
+	}
+	for _, port := range []int{8000, 8001, 8003} {
+		if counts[port] < 50 {
+			t.Errorf("instance %d got %d of 300 requests, want them spread over the running instances", port, counts[port])
+		}
+	}
+}
+
+// TestConcurrentRequestsDuringRestart 请求处理时不加锁读取实例，和滚动重启同时进行，用 -race 检查
+func TestConcurrentRequestsDuringRestart(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	service := newTestService(t, config.ServiceData{}, upstream, upstream)
+
+	stop := make(chan struct{})
+	var restarter sync.WaitGroup
+	restarter.Add(1)
+	go func() {
+		defer restarter.Done()
+		port := upstreamPort(t, upstream)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			instance := service.Instances()[1]
+			instance.NeedRestart.Store(true)
+			instance.setPid(strconv.Itoa(2000 + i))
+			replacement := newInstance(strconv.Itoa(3000+i), port)
+			service.setInstance(0, replacement)
+			service.markRunning(replacement)
+			instance.NeedRestart.Store(false)
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 20; j++ {
+				if w := serve(service, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusOK {
+					t.Errorf("status = %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	restarter.Wait()
+}
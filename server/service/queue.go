@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultQueueMaxWait = 10
+
+// instanceReady 有实例进入可服务状态时通知等待的请求
+type instanceReady struct {
+	mutex   sync.Mutex
+	ch      chan struct{}
+	waiting int
+}
+
+// wait 返回一个在下次有实例可用时被关闭的 channel
+func (ready *instanceReady) wait() <-chan struct{} {
+	ready.mutex.Lock()
+	defer ready.mutex.Unlock()
+	if ready.ch == nil {
+		ready.ch = make(chan struct{})
+	}
+	return ready.ch
+}
+
+func (ready *instanceReady) notify() {
+	ready.mutex.Lock()
+	defer ready.mutex.Unlock()
+	if ready.ch != nil {
+		close(ready.ch)
+		ready.ch = nil
+	}
+}
+
+// enter 排队的请求数没有超过上限时进入队列
+func (ready *instanceReady) enter(maxLength int) bool {
+	ready.mutex.Lock()
+	defer ready.mutex.Unlock()
+	if ready.waiting >= maxLength {
+		return false
+	}
+	ready.waiting++
+	return true
+}
+
+func (ready *instanceReady) leave() {
+	ready.mutex.Lock()
+	defer ready.mutex.Unlock()
+	ready.waiting--
+}
+
+// markRunning 实例进入可服务状态，唤醒排队等待实例的请求
+func (service *Service) markRunning(instance *Instance) {
+	instance.Status.Store(StatusRunning)
+	service.ready.notify()
+}
+
+// waitForInstance 没有可用实例时（比如只有一个实例正在重启），在队列里等待实例恢复
+// 队列已满、等待超时或者客户端断开时返回 nil
+func (service *Service) waitForInstance(ctx context.Context) *Instance {
+	queue := service.Data.WaitQueue
+	if queue.MaxLength <= 0 {
+		return nil
+	}
+	if !service.ready.enter(queue.MaxLength) {
+		queueRejected.Inc(service.Name, "full")
+		return nil
+	}
+	queueWaiting.Inc(service.Name)
+	defer func() {
+		service.ready.leave()
+		queueWaiting.Dec(service.Name)
+	}()
+
+	maxWait := queue.MaxWait
+	if maxWait <= 0 {
+		maxWait = defaultQueueMaxWait
+	}
+	timer := time.NewTimer(time.Duration(maxWait) * time.Second)
+	defer timer.Stop()
+
+	for {
+		//先拿到 channel 再检查实例，避免检查之后、等待之前的通知丢失
+		ready := service.ready.wait()
+		if instance := service.SelectInstance(); instance != nil {
+			return instance
+		}
+		select {
+		case <-ready:
+		case <-timer.C:
+			queueRejected.Inc(service.Name, "timeout")
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
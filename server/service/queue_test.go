@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"testing"
+	"time"
+)
+
+// restartingService 唯一的实例正在重启，还不能接收请求
+func restartingService(t *testing.T, queue config.WaitQueueConfig) (*Service, *Instance) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+	service := newTestService(t, config.ServiceData{WaitQueue: queue}, upstream)
+	instance := service.Instances()[0]
+	instance.Status.Store(StatusWillRunning)
+	return service, instance
+}
+
+// waitQueued 等到有 n 个请求在排队
+func waitQueued(t *testing.T, service *Service, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		service.ready.mutex.Lock()
+		waiting := service.ready.waiting
+		service.ready.mutex.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("%d requests are not queued", n)
+}
+
+func TestQueueWaitsForRestart(t *testing.T) {
+	service, instance := restartingService(t, config.WaitQueueConfig{MaxLength: 10, MaxWait: 5})
+	done := make(chan int)
+	for i := 0; i < 3; i++ {
+		go func() {
+			done <- serve(service, httptest.NewRequest("GET", "/", nil)).Code
+		}()
+	}
+	waitQueued(t, service, 3)
+	service.markRunning(instance)
+	for i := 0; i < 3; i++ {
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("queued request got %d, want 200", status)
+		}
+	}
+	waitQueued(t, service, 0)
+}
+
+func TestQueueRejects(t *testing.T) {
+	t.Run("no queue", func(t *testing.T) {
+		service, _ := restartingService(t, config.WaitQueueConfig{})
+		if status := serve(service, httptest.NewRequest("GET", "/", nil)).Code; status != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want 503", status)
+		}
+	})
+
+	t.Run("full", func(t *testing.T) {
+		service, instance := restartingService(t, config.WaitQueueConfig{MaxLength: 1, MaxWait: 5})
+		first := make(chan int)
+		go func() {
+			first <- serve(service, httptest.NewRequest("GET", "/", nil)).Code
+		}()
+		waitQueued(t, service, 1)
+		if status := serve(service, httptest.NewRequest("GET", "/", nil)).Code; status != http.StatusServiceUnavailable {
+			t.Errorf("request over max_length got %d, want 503", status)
+		}
+		service.markRunning(instance)
+		if status := <-first; status != http.StatusOK {
+			t.Errorf("queued request got %d, want 200", status)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		service, _ := restartingService(t, config.WaitQueueConfig{MaxLength: 1, MaxWait: 1})
+		start := time.Now()
+		status := serve(service, httptest.NewRequest("GET", "/", nil)).Code
+		if elapsed := time.Since(start); status != http.StatusServiceUnavailable || elapsed < time.Second {
+			t.Errorf("status = %d after %s, want 503 after max_wait", status, elapsed)
+		}
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		service, _ := restartingService(t, config.WaitQueueConfig{MaxLength: 1, MaxWait: 5})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if instance := service.waitForInstance(ctx); instance != nil || time.Since(start) > time.Second {
+			t.Errorf("waitForInstance() = %v after %s, want nil once the client is gone", instance, time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	defaultRequestIdHeader = "X-Request-ID"
+	maxRequestIdLength     = 128
+)
+
+// requestIdHeader 请求 ID 使用的头，可以在服务配置里修改
+func (service *Service) requestIdHeader() string {
+	if service.Data.RequestIdHeader != "" {
+		return service.Data.RequestIdHeader
+	}
+	return defaultRequestIdHeader
+}
+
+// requestId 使用客户端（或前面的 nginx）传过来的请求 ID，没有或者不合法时生成一个新的
+func (service *Service) requestId(r *http.Request) string {
+	requestId := r.Header.Get(service.requestIdHeader())
+	if validRequestId(requestId) {
+		return requestId
+	}
+	return newRequestId()
+}
+
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(requestId); i++ {
+		if requestId[i] <= ' ' || requestId[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestId(t *testing.T) {
+	tests := []struct {
+		requestId string
+		want      bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"0f1e2d3c4b5a69788796a5b4c3d2e1f0", true},
+		{strings.Repeat("a", maxRequestIdLength), true},
+		{strings.Repeat("a", maxRequestIdLength+1), false},
+		{"has space", false},
+		{"new\nline", false},
+		{"中文", false},
+		{"del\x7f", false},
+	}
+	for _, test := range tests {
+		if got := validRequestId(test.requestId); got != test.want {
+			t.Errorf("validRequestId(%q) = %v, want %v", test.requestId, got, test.want)
+		}
+	}
+}
+
+func TestNewRequestId(t *testing.T) {
+	first, second := newRequestId(), newRequestId()
+	if len(first) != 32 || !validRequestId(first) || first == second {
+		t.Errorf("newRequestId() = %q, %q", first, second)
+	}
+}
+
+func TestRequestIdPassThrough(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Trace-Id")
+	}))
+	defer upstream.Close()
+	service := newTestService(t, config.ServiceData{RequestIdHeader: "X-Trace-Id"}, upstream)
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "kept", incoming: "from-nginx-1", keep: true},
+		{name: "generated", incoming: "", keep: false},
+		{name: "invalid replaced", incoming: "bad id", keep: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.incoming != "" {
+				r.Header.Set("X-Trace-Id", test.incoming)
+			}
+			w := serve(service, r)
+			echoed := w.Header().Get("X-Trace-Id")
+			if echoed == "" || echoed != forwarded {
+				t.Fatalf("response id %q, instance got %q", echoed, forwarded)
+			}
+			if (echoed == test.incoming) != test.keep {
+				t.Errorf("request id = %q, incoming %q, want kept %v", echoed, test.incoming, test.keep)
+			}
+		})
+	}
+
+	//没有可用实例时错误页也带上请求 ID
+	service.storeInstances(nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Trace-Id", "lost-1")
+	w := serve(service, r)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "lost-1") {
+		t.Errorf("error page = %d %q, want 503 with the request id", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"net"
+	"net/http"
+)
+
+// responseRecorder 记录代理响应的状态码和字节数，用于指标统计
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	onHijack func(net.Conn) net.Conn //升级连接被 Hijack 时包装客户端连接
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += int64(n)
+	return n, err
+}
+
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap 让 http.ResponseController 能拿到原始的 ResponseWriter，升级连接时需要 Hijack
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// Status 没有写入过响应时返回 200，和 net/http 的行为一致
+func (recorder *responseRecorder) Status() int {
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const defaultRetryBodySize = 64 * 1024
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryTransport 请求实例失败时换一个实例重试
+// 连接错误时，幂等的请求和请求体可以重放的请求都会重试；非幂等的请求只在连接实例失败（请求还没发出去）时重试
+// 配置了 on_status 时，幂等的请求收到这些状态码也会重试
+type retryTransport struct {
+	service   *Service
+	transport http.RoundTripper
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pc := getProxyContext(req)
+	retry := rt.service.Data.Retry
+	if pc == nil || retry.Attempts <= 0 {
+		return rt.transport.RoundTrip(req)
+	}
+
+	tried := map[*Instance]bool{pc.instance: true}
+	for {
+		res, err := rt.transport.RoundTrip(req)
+		if pc.retries >= retry.Attempts || !rt.shouldRetry(req, res, err) {
+			return res, err
+		}
+
+		next := rt.service.selectInstanceExcept(tried)
+		if next == nil {
+			return res, err
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				rt.service.releaseInstance(next)
+				return res, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				rt.service.releaseInstance(next)
+				return res, err
+			}
+			req.Body = body
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			_ = res.Body.Close()
+		}
+
+		reason := "error"
+		if err == nil {
+			reason = strconv.Itoa(res.StatusCode)
+		}
+		upstreamRetries.Inc(rt.service.Name, strconv.Itoa(pc.instance.Port), reason)
+		log.Info("retry request on another instance", zap.String("service", rt.service.Name),
+			zap.Int("from_port", pc.instance.Port), zap.Int("to_port", next.Port),
+			zap.String("request_id", pc.requestId), zap.String("reason", reason), zap.Error(err))
+
+		tried[next] = true
+		rt.service.releaseInstance(pc.instance)
+		pc.retries++
+		pc.instance = next
+		pc.upstreamPid = next.Pid()
+		pc.upstream = rt.service.upstreamAddr(next)
+		req.URL.Host = pc.upstream
+		req.Host = rt.service.upstreamHost(pc.in, pc.upstream)
+	}
+}
+
+func (rt *retryTransport) shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		//客户端已经断开
+		return false
+	}
+	idempotent := idempotentMethods[req.Method]
+	if err != nil {
+		if isDialError(err) {
+			return true
+		}
+		return idempotent && replayable(req)
+	}
+	return idempotent && replayable(req) && slices.Contains(rt.service.Data.Retry.OnStatus, res.StatusCode)
+}
+
+// replayable 请求体是否可以重新发送一次
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isDialError 连接实例时就失败了，请求一定没有被实例处理过
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// bufferRequestBody 开启重试时把不太大的请求体读到内存里，这样换实例时可以重新发送
+func (service *Service) bufferRequestBody(r *http.Request) {
+	retry := service.Data.Retry
+	if retry.Attempts <= 0 || r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return
+	}
+	limit := retry.MaxBodySize
+	if limit <= 0 {
+		limit = defaultRetryBodySize
+	}
+	if r.ContentLength < 0 || r.ContentLength > limit {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		//读失败或者比声明的大，剩下的交给 ReverseProxy 原样转发
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// selectInstanceExcept 选一个可以服务且没有试过的实例
+func (service *Service) selectInstanceExcept(tried map[*Instance]bool) *Instance {
+	for i := 0; i < len(service.Instances()); i++ {
+		instance := service.SelectInstance()
+		if instance == nil {
+			return nil
+		}
+		if !tried[instance] {
+			return instance
+		}
+		service.releaseInstance(instance)
+	}
+	return nil
+}
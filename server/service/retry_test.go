@@ -0,0 +1,153 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"strings"
+	"testing"
+)
+
+// deadUpstream 已经关闭的实例，连接时直接被拒绝
+func deadUpstream() *httptest.Server {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	return upstream
+}
+
+// firstInstance 让下一个请求先选中第 index 个实例
+func firstInstance(service *Service, index int) {
+	count := uint64(len(service.Instances()))
+	service.instanceIndex.Store((uint64(index) + count - 1) % count)
+}
+
+func TestRetryOnDialError(t *testing.T) {
+	var bodies []string
+	alive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		_, _ = w.Write([]byte("alive"))
+	}))
+	defer alive.Close()
+	dead := deadUpstream()
+
+	tests := []struct {
+		name       string
+		retry      config.RetryConfig
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string //实例收到的请求体
+	}{
+		{name: "no retry", method: "GET", wantStatus: http.StatusBadGateway},
+		{name: "get", retry: config.RetryConfig{Attempts: 1}, method: "GET", wantStatus: http.StatusOK},
+		{name: "post body is replayed", retry: config.RetryConfig{Attempts: 1}, method: "POST", body: "order=1", wantStatus: http.StatusOK, wantBody: "order=1"},
+		{name: "body too large to replay", retry: config.RetryConfig{Attempts: 1, MaxBodySize: 4}, method: "POST", body: "order=1", wantStatus: http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bodies = nil
+			service := newTestService(t, config.ServiceData{Retry: test.retry}, dead, alive)
+			firstInstance(service, 0)
+			r := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+			w := serve(service, r)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusOK && (len(bodies) != 1 || bodies[0] != test.wantBody) {
+				t.Errorf("instance got bodies %q, want %q", bodies, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	var requests int
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	alive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer alive.Close()
+
+	tests := []struct {
+		name         string
+		retry        config.RetryConfig
+		method       string
+		wantStatus   int
+		wantRequests int
+	}{
+		{name: "idempotent", retry: config.RetryConfig{Attempts: 2, OnStatus: []int{503}}, method: "GET", wantStatus: http.StatusOK, wantRequests: 2},
+		{name: "not listed", retry: config.RetryConfig{Attempts: 2, OnStatus: []int{502}}, method: "GET", wantStatus: http.StatusServiceUnavailable, wantRequests: 1},
+		{name: "post is not retried", retry: config.RetryConfig{Attempts: 2, OnStatus: []int{503}}, method: "POST", wantStatus: http.StatusServiceUnavailable, wantRequests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests = 0
+			service := newTestService(t, config.ServiceData{Retry: test.retry}, unavailable, alive)
+			firstInstance(service, 0)
+			w := serve(service, httptest.NewRequest(test.method, "/", nil))
+			if w.Code != test.wantStatus || requests != test.wantRequests {
+				t.Errorf("status = %d after %d requests, want %d after %d", w.Code, requests, test.wantStatus, test.wantRequests)
+			}
+		})
+	}
+}
+
+// TestRetryAttempts 每个实例只试一次，次数用完后返回最后的错误
+func TestRetryAttempts(t *testing.T) {
+	service := newTestService(t, config.ServiceData{Retry: config.RetryConfig{Attempts: 5}}, deadUpstream(), deadUpstream())
+	w := serve(service, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", w.Code)
+	}
+	for _, instance := range service.Instances() {
+		if active := instance.activeRequests.Load(); active != 0 {
+			t.Errorf("instance %d still has %d active requests", instance.Port, active)
+		}
+	}
+}
+
+func TestBufferRequestBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		retry       config.RetryConfig
+		body        string
+		unknownSize bool
+		wantReplay  bool
+	}{
+		{name: "retry disabled", body: "data", wantReplay: false},
+		{name: "small body", retry: config.RetryConfig{Attempts: 1}, body: "data", wantReplay: true},
+		{name: "over max_body_size", retry: config.RetryConfig{Attempts: 1, MaxBodySize: 3}, body: "data", wantReplay: false},
+		{name: "unknown length", retry: config.RetryConfig{Attempts: 1}, body: "data", unknownSize: true, wantReplay: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", Data: config.ServiceData{Retry: test.retry}}
+			r := httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader(test.body)))
+			if test.unknownSize {
+				r.ContentLength = -1
+			} else {
+				r.ContentLength = int64(len(test.body))
+			}
+			service.bufferRequestBody(r)
+			if replayable(r) != test.wantReplay {
+				t.Fatalf("replayable() = %v, want %v", replayable(r), test.wantReplay)
+			}
+			//缓存与否都不能丢掉请求体
+			if body, _ := io.ReadAll(r.Body); string(body) != test.body {
+				t.Errorf("body = %q, want %q", body, test.body)
+			}
+			if test.wantReplay {
+				again, _ := r.GetBody()
+				if body, _ := io.ReadAll(again); string(body) != test.body {
+					t.Errorf("replayed body = %q", body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"net/http"
+	"smoothserver/config"
+	"time"
+)
+
+// redirectInstance 重定向规则直接返回的请求在指标里的 instance 标签
+const redirectInstance = "redirect"
+
+// applyRewrites 转发给实例前按顺序执行改写规则，返回 true 表示已经返回了重定向，不需要再转发
+func (service *Service) applyRewrites(w http.ResponseWriter, r *http.Request, requestId string) bool {
+	//match 在加载配置时已经编译好，Regex 为 nil 时匹配所有路径
+	for i := range service.Data.Rewrite.Rules {
+		rule := &service.Data.Rewrite.Rules[i]
+		path := r.URL.Path
+		var match []int
+		if rule.Regex != nil {
+			if match = rule.Regex.FindStringSubmatchIndex(path); match == nil {
+				continue
+			}
+		}
+		// 模板里的 $1、${name} 引用 match 的分组
+		expand := func(template string) string {
+			if rule.Regex == nil {
+				return template
+			}
+			return string(rule.Regex.ExpandString(nil, template, path, match))
+		}
+
+		if rule.Path != "" {
+			r.URL.Path = expand(rule.Path)
+			r.URL.RawPath = ""
+		}
+		if len(rule.QuerySet) > 0 || len(rule.QueryAdd) > 0 || len(rule.QueryRemove) > 0 {
+			query := r.URL.Query()
+			for _, name := range rule.QueryRemove {
+				query.Del(name)
+			}
+			for name, value := range rule.QuerySet {
+				query.Set(name, expand(value))
+			}
+			for name, value := range rule.QueryAdd {
+				query.Add(name, expand(value))
+			}
+			r.URL.RawQuery = query.Encode()
+		}
+
+		if rule.Redirect != 0 {
+			location := r.URL.RequestURI()
+			if rule.Location != "" {
+				location = expand(rule.Location)
+			}
+			service.redirect(w, r, location, rule.Redirect, requestId)
+			return true
+		}
+		if rule.Last {
+			break
+		}
+	}
+	return false
+}
+
+// redirect 重定向也统计指标并记录访问日志
+func (service *Service) redirect(w http.ResponseWriter, r *http.Request, location string, status int, requestId string) {
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+	recorder.Header().Set(service.requestIdHeader(), requestId)
+	http.Redirect(recorder, r, location, status)
+	requestsTotal.Inc(service.Name, redirectInstance, statusClass(status))
+	service.accessLog.Log(service.newAccessEntry(r, recorder, start, requestId))
+}
+
+// applyHeaderRules 先删除，再设置，最后追加
+func applyHeaderRules(header http.Header, rules config.HeaderRules) {
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		header.Add(name, value)
+	}
+}
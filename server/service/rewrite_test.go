@@ -0,0 +1,120 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"testing"
+)
+
+func TestApplyRewrites(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        []config.RewriteRule
+		target       string
+		wantUri      string //没有重定向时转发给实例的路径和查询参数
+		wantStatus   int    //重定向的状态码
+		wantLocation string
+	}{
+		{
+			name:    "numbered group",
+			rules:   []config.RewriteRule{{Match: `^/old/(.*)$`, Path: "/new/$1"}},
+			target:  "/old/a/b?x=1",
+			wantUri: "/new/a/b?x=1",
+		},
+		{
+			name:    "named group",
+			rules:   []config.RewriteRule{{Match: `^/users/(?P<id>\d+)$`, Path: "/profile", QuerySet: map[string]string{"id": "${id}"}}},
+			target:  "/users/42",
+			wantUri: "/profile?id=42",
+		},
+		{
+			name:    "no match",
+			rules:   []config.RewriteRule{{Match: `^/old/`, Path: "/new"}},
+			target:  "/other",
+			wantUri: "/other",
+		},
+		{
+			name:    "literal dollar without match",
+			rules:   []config.RewriteRule{{Path: "/fixed/$1"}},
+			target:  "/any",
+			wantUri: "/fixed/$1",
+		},
+		{
+			name:    "query remove, set and add",
+			rules:   []config.RewriteRule{{QueryRemove: []string{"utm_source"}, QuerySet: map[string]string{"v": "2"}, QueryAdd: map[string]string{"tag": "b"}}},
+			target:  "/p?utm_source=mail&v=1&tag=a",
+			wantUri: "/p?tag=a&tag=b&v=2",
+		},
+		{
+			name: "rules run in order",
+			rules: []config.RewriteRule{
+				{Match: `^/a$`, Path: "/b"},
+				{Match: `^/b$`, Path: "/c"},
+			},
+			target:  "/a",
+			wantUri: "/c",
+		},
+		{
+			name: "last stops later rules",
+			rules: []config.RewriteRule{
+				{Match: `^/a$`, Path: "/b", Last: true},
+				{Match: `^/b$`, Path: "/c"},
+			},
+			target:  "/a",
+			wantUri: "/b",
+		},
+		{
+			name:         "redirect to template",
+			rules:        []config.RewriteRule{{Match: `^/blog/(\d+)$`, Redirect: http.StatusMovedPermanently, Location: "https://blog.example.com/posts/$1"}},
+			target:       "/blog/7",
+			wantStatus:   http.StatusMovedPermanently,
+			wantLocation: "https://blog.example.com/posts/7",
+		},
+		{
+			name:         "redirect to rewritten path",
+			rules:        []config.RewriteRule{{Match: `^/docs$`, Path: "/docs/", QueryAdd: map[string]string{"from": "old"}, Redirect: http.StatusFound}},
+			target:       "/docs",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/docs/?from=old",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", Data: validatedData(t, config.ServiceData{Rewrite: config.RewriteConfig{Rules: test.rules}})}
+			r := httptest.NewRequest("GET", test.target, nil)
+			w := httptest.NewRecorder()
+			redirected := service.applyRewrites(w, r, "request-id")
+			if redirected != (test.wantStatus != 0) {
+				t.Fatalf("applyRewrites() = %v, want redirect %v", redirected, test.wantStatus != 0)
+			}
+			if !redirected {
+				if got := r.URL.RequestURI(); got != test.wantUri {
+					t.Errorf("request uri = %q, want %q", got, test.wantUri)
+				}
+				return
+			}
+			if w.Code != test.wantStatus || w.Header().Get("Location") != test.wantLocation {
+				t.Errorf("redirect = %d %q, want %d %q", w.Code, w.Header().Get("Location"), test.wantStatus, test.wantLocation)
+			}
+		})
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	header := http.Header{"Server": {"instance"}, "X-Powered-By": {"php"}, "Cache-Control": {"private"}}
+	applyHeaderRules(header, config.HeaderRules{
+		Remove: []string{"X-Powered-By", "Cache-Control"},
+		Set:    map[string]string{"Server": "smoothserve", "Cache-Control": "no-store"},
+		Add:    map[string]string{"Vary": "Accept"},
+	})
+	want := http.Header{"Server": {"smoothserve"}, "Cache-Control": {"no-store"}, "Vary": {"Accept"}}
+	if len(header) != len(want) {
+		t.Fatalf("header = %v, want %v", header, want)
+	}
+	for name, values := range want {
+		if header.Get(name) != values[0] {
+			t.Errorf("%s = %q, want %q", name, header.Get(name), values[0])
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"net/http"
+	"slices"
+	"smoothserver/config"
+	"strings"
+)
+
+// 相同优先级时按匹配方式排序：完全匹配、前缀（长的优先）、正则
+const (
+	routeExact = iota
+	routePrefix
+	routeRegex
+)
+
+// routeRule 编译好的路由规则，nil 表示匹配域名下的所有请求
+type routeRule struct {
+	config.RouteConfig
+	static *staticHandler //静态文件路由，不转发给实例
+	access *accessControl //路由的访问控制，没有配置时为 nil
+}
+
+// compileRoutes 配置里的路由规则，没有配置时服务处理域名下的所有请求
+func (service *Service) compileRoutes() []*routeRule {
+	if len(service.Data.Routes) == 0 {
+		return []*routeRule{nil}
+	}
+	var rules []*routeRule
+	for _, routeConfig := range service.Data.Routes {
+		//path_regex 在加载配置时已经编译好，有无效正则的服务不会被创建
+		rule := &routeRule{RouteConfig: routeConfig}
+		rule.access = service.newAccessControl(routeConfig.Access)
+		if routeConfig.Static.Root != "" {
+			rule.static = service.newStaticHandler(routeConfig.Static)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (rule *routeRule) priority() int {
+	if rule == nil {
+		return 0
+	}
+	return rule.Priority
+}
+
+func (rule *routeRule) kind() int {
+	switch {
+	case rule == nil:
+		return routePrefix
+	case rule.Path != "":
+		return routeExact
+	case rule.Regex != nil:
+		return routeRegex
+	}
+	return routePrefix
+}
+
+func (rule *routeRule) prefixLength() int {
+	if rule == nil {
+		return 0
+	}
+	return len(rule.PathPrefix)
+}
+
+// match 请求是否满足规则，满足时返回转发给实例的路径
+func (rule *routeRule) match(r *http.Request) (string, bool) {
+	path := r.URL.Path
+	if rule == nil {
+		return path, true
+	}
+	if len(rule.Methods) > 0 && !slices.ContainsFunc(rule.Methods, func(method string) bool { return strings.EqualFold(method, r.Method) }) {
+		return "", false
+	}
+	for name, value := range rule.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || value != "*" && !slices.Contains(values, value) {
+			return "", false
+		}
+	}
+
+	switch {
+	case rule.Path != "":
+		if path != rule.Path {
+			return "", false
+		}
+		if rule.Rewrite != "" {
+			return rule.Rewrite, true
+		}
+		return path, true
+	case rule.Regex != nil:
+		if !rule.Regex.MatchString(path) {
+			return "", false
+		}
+		if rule.Rewrite != "" {
+			return rule.Regex.ReplaceAllString(path, rule.Rewrite), true
+		}
+		return path, true
+	}
+
+	if !hasPathPrefix(path, rule.PathPrefix) {
+		return "", false
+	}
+	if !rule.StripPrefix && rule.Rewrite == "" {
+		return path, true
+	}
+	rest := strings.TrimPrefix(path, rule.PathPrefix)
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	if rule.Rewrite == "" {
+		return rest, true
+	}
+	return strings.TrimSuffix(rule.Rewrite, "/") + rest, true
+}
+
+// hasPathPrefix 按路径段匹配前缀，/api 匹配 /api 和 /api/users，不匹配 /apis；以 / 结尾的前缀直接比较
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// handler 静态文件路由由 smoothserve 直接处理，其它的交给注册时的 handler；配置了访问控制时先检查
+func (rule *routeRule) handler(handler http.HandlerFunc) http.HandlerFunc {
+	if rule == nil {
+		return handler
+	}
+	if rule.static != nil {
+		handler = rule.static.ServeHTTP
+	}
+	return rule.access.wrap(handler)
+}
+
+// rewriteRequest 路径变化时复制请求再修改，原来的请求（和访问日志里的路径）保持不变
+func (rule *routeRule) rewriteRequest(r *http.Request, path string) *http.Request {
+	if path == r.URL.Path {
+		return r
+	}
+	rewritten := r.Clone(r.Context())
+	rewritten.URL.Path = path
+	rewritten.URL.RawPath = ""
+	if rule.StripPrefix {
+		// 让实例知道自己被挂在哪个前缀下，用于生成链接
+		rewritten.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(rule.PathPrefix, "/"))
+	}
+	return rewritten
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"net/http/httptest"
+	"smoothserver/config"
+	"testing"
+)
+
+// validatedData 像加载配置时一样检查服务配置，路由和改写规则里会带上编译好的正则
+func validatedData(t *testing.T, data config.ServiceData) config.ServiceData {
+	t.Helper()
+	if err := config.ValidateInstanceSettings(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{"/api", "/api", true},
+		{"/api/users", "/api", true},
+		{"/apis", "/api", false},
+		{"/ap", "/api", false},
+		{"/api/users", "/api/", true},
+		{"/api", "/api/", false},
+		{"/anything", "/", true},
+	}
+	for _, test := range tests {
+		if got := hasPathPrefix(test.path, test.prefix); got != test.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", test.path, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    config.RouteConfig
+		method   string
+		path     string
+		headers  map[string]string
+		wantPath string
+		wantOk   bool
+	}{
+		{name: "exact", route: config.RouteConfig{Path: "/login"}, path: "/login", wantPath: "/login", wantOk: true},
+		{name: "exact miss", route: config.RouteConfig{Path: "/login"}, path: "/login/x", wantOk: false},
+		{name: "exact rewrite", route: config.RouteConfig{Path: "/login", Rewrite: "/auth/login"}, path: "/login", wantPath: "/auth/login", wantOk: true},
+		{name: "prefix", route: config.RouteConfig{PathPrefix: "/api"}, path: "/api/users", wantPath: "/api/users", wantOk: true},
+		{name: "prefix by segment", route: config.RouteConfig{PathPrefix: "/api"}, path: "/apis", wantOk: false},
+		{name: "strip prefix", route: config.RouteConfig{PathPrefix: "/api", StripPrefix: true}, path: "/api/users", wantPath: "/users", wantOk: true},
+		{name: "strip whole path", route: config.RouteConfig{PathPrefix: "/api", StripPrefix: true}, path: "/api", wantPath: "/", wantOk: true},
+		{name: "prefix rewrite", route: config.RouteConfig{PathPrefix: "/old", Rewrite: "/new/"}, path: "/old/page", wantPath: "/new/page", wantOk: true},
+		{name: "regex rewrite", route: config.RouteConfig{PathRegex: `^/v1/(.*)$`, Rewrite: "/api/$1"}, path: "/v1/users", wantPath: "/api/users", wantOk: true},
+		{name: "regex miss", route: config.RouteConfig{PathRegex: `^/v1/`}, path: "/v2/users", wantOk: false},
+		{name: "method", route: config.RouteConfig{PathPrefix: "/api", Methods: []string{"POST"}}, method: "post", path: "/api", wantPath: "/api", wantOk: true},
+		{name: "method miss", route: config.RouteConfig{PathPrefix: "/api", Methods: []string{"POST"}}, method: "GET", path: "/api", wantOk: false},
+		{name: "header value", route: config.RouteConfig{Headers: map[string]string{"X-Version": "2"}}, path: "/", headers: map[string]string{"X-Version": "2"}, wantPath: "/", wantOk: true},
+		{name: "header value miss", route: config.RouteConfig{Headers: map[string]string{"X-Version": "2"}}, path: "/", headers: map[string]string{"X-Version": "1"}, wantOk: false},
+		{name: "header any value", route: config.RouteConfig{Headers: map[string]string{"X-Canary": "*"}}, path: "/", headers: map[string]string{"X-Canary": "yes"}, wantPath: "/", wantOk: true},
+		{name: "header missing", route: config.RouteConfig{Headers: map[string]string{"X-Canary": "*"}}, path: "/", wantOk: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", Data: validatedData(t, config.ServiceData{Routes: []config.RouteConfig{test.route}})}
+			rule := service.compileRoutes()[0]
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, test.path, nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			path, ok := rule.match(r)
+			if ok != test.wantOk || path != test.wantPath {
+				t.Errorf("match(%s %s) = %q, %v, want %q, %v", method, test.path, path, ok, test.wantPath, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestRouteWithoutRulesMatchesEverything(t *testing.T) {
+	service := &Service{Name: "test"}
+	rules := service.compileRoutes()
+	if len(rules) != 1 || rules[0] != nil {
+		t.Fatalf("compileRoutes() = %v, want a single nil rule", rules)
+	}
+	path, ok := rules[0].match(httptest.NewRequest("DELETE", "/any/path", nil))
+	if !ok || path != "/any/path" {
+		t.Errorf("match() = %q, %v, want %q, true", path, ok, "/any/path")
+	}
+}
@@ -2,18 +2,22 @@ package service
 
 import (
 	"bufio"
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 	"go_service_core/core/log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"smoothserver/config"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,27 +31,94 @@ const (
 )
 
 type Instance struct {
-	Pid         string
 	Port        int
-	Status      int
-	Host        string
-	NeedRestart bool
+	Status      atomic.Int32 //处理请求时不加锁读取
+	NeedRestart atomic.Bool  //滚动重启时在实例退出的 goroutine 里读写
+
+	pid atomic.Pointer[string] //重启后换成新进程的 pid，处理请求时不加锁读取
+
+	longMutex sync.Mutex
+	longConns map[*longConn]struct{} //实例上的 WebSocket、SSE 长连接
+
+	activeRequests atomic.Int64 //正在处理的请求数，用于每个实例的并发上限
+}
+
+func newInstance(pid string, port int) *Instance {
+	instance := &Instance{Port: port}
+	instance.setPid(pid)
+	return instance
+}
+
+// Pid 实例当前进程的 pid
+func (instance *Instance) Pid() string {
+	if pid := instance.pid.Load(); pid != nil {
+		return *pid
+	}
+	return ""
+}
+
+func (instance *Instance) setPid(pid string) {
+	instance.pid.Store(&pid)
 }
 
 type Service struct {
 	Name          string
-	Data          config.ServiceData
-	Instances     []*Instance
-	instanceIndex int
+	Data          config.ServiceData          //创建后不再修改，处理请求时可以直接读取；滚动重启时重新读取的实例设置放在 instanceConfig 里
+	instances     atomic.Pointer[[]*Instance] //处理请求时不加锁读取，修改时复制一份后整体替换
+	instanceIndex atomic.Uint64
 	initialized   bool //服务已经被初始化，创建了实例、文件监听等
 	mutex         sync.Mutex
 	watcher       *fsnotify.Watcher
 	restartTimer  *time.Timer     //重启时的定时器，等待几秒后，如果时间没有被刷新，则正式开始重启
 	stopWg        *sync.WaitGroup //当服务的实例等待停止时，要设定完成以便于在停止所有实例时，能够安全退出serve
+
+	instanceConfig atomic.Pointer[config.ServiceData] //启动实例使用的设置（环境变量、参数、用户、资源限制），滚动重启时整体替换
+
+	crashMutex     sync.Mutex
+	crashes        []CrashRecord          //实例非预期退出的历史记录
+	rolloutStart   time.Time              //滚动重启开始的时间，用于统计重启整个服务的耗时，由 mutex 保护
+	accessLog      *accessLogger          //访问日志，没有开启时为 nil
+	trustedProxies []*net.IPNet           //可信的代理，从它们传过来的 X-Forwarded-* 才会被采用
+	proxy          *httputil.ReverseProxy //服务的所有请求共用一个反向代理和连接池
+	ready          instanceReady          //没有可用实例时排队的请求在这里等待
+	rateLimiters   []*rateLimiter         //令牌桶限流规则
+	activeRequests atomic.Int64           //正在转发的请求数，用于服务的并发上限
+	compression    *compression           //压缩实例的响应，没有开启时为 nil
+	access         *accessControl         //服务的访问控制，没有配置时为 nil
+	errorPages     errorPages             //错误页和维护页的模板
+
+	maintenance      atomic.Bool  //维护模式，返回维护页，实例继续运行
+	maintenanceAllow []*net.IPNet //维护时仍然可以访问实例的 IP
+
+	tlsConfig   *tls.Config                     //配置了 HTTPS 时按 SNI 选中这个服务后使用
+	certificate atomic.Pointer[tls.Certificate] //当前使用的证书，文件变化后替换
+	certDirs    map[string]bool                 //只为了证书而监视的目录
+	watchPaths  map[string]bool                 //watch_files 里的文件和目录，变化后要重启实例
+	certTimer   *time.Timer
+	acmeManager *acmeManager //开启 ACME 时自动申请和续期证书
 }
 
 func New(serviceData config.ServiceData) *Service {
 	service := Service{Name: serviceData.Name, Data: serviceData}
+	service.instanceConfig.Store(&serviceData)
+	service.accessLog = newAccessLogger(serviceData.AccessLog)
+	service.trustedProxies = parseTrustedProxies(serviceData.Name, serviceData.TrustedProxies)
+	service.proxy = service.newReverseProxy()
+	service.compression = newCompression(serviceData.Compression)
+	service.access = service.newAccessControl(serviceData.Access)
+	service.rateLimiters = newRateLimiters(serviceData.RateLimits)
+	service.maintenanceAllow = parseNetworks(serviceData.Name, "maintenance allow", serviceData.Maintenance.Allow)
+	service.SetMaintenance(serviceData.Maintenance.Enabled)
+	if serviceData.Tls.Acme.Enabled {
+		manager, err := service.newAcmeManager()
+		if err != nil {
+			log.Error("create acme manager failed, https handshakes fail until it is fixed", zap.String("service", service.Name), zap.Error(err))
+		}
+		service.acmeManager = manager
+	}
+	if serviceData.Tls.Enabled() {
+		service.tlsConfig = service.newTlsConfig()
+	}
 	return &service
 }
 func (service *Service) CreateAndListen() {
@@ -61,35 +132,61 @@ func (service *Service) CreateAndListen() {
 	//service.initialized = true
 	go service.initWatcher()
 
-	//检测是否有多个名字,给每一个域名都做反向代理
-
-	go func() {
-		serverNameArr := strings.Split(service.Data.ServerName, ",")
-		for _, serverName := range serverNameArr {
-			serverName := strings.TrimSpace(serverName)
-			http.HandleFunc(serverName+"/", service.handleRequest)
+	if service.Data.Tls.CertFile != "" {
+		if err := service.loadCertificate(); err != nil {
+			log.Error("load certificate failed, https handshakes fail until it is fixed", zap.String("service", service.Name), zap.Error(err))
 		}
+	}
 
-		log.Info("Start service ", zap.String("name", service.Name), zap.Int("port", service.Data.Port))
-
-		err := http.ListenAndServe(fmt.Sprintf(":%d", service.Data.Port), nil)
+	//检测是否有多个名字,给每一个域名都做反向代理；多个服务可以共用一个端口
+	listener, err := getListener(service.Data.Port, service.Data.Tls.Enabled())
+	if err != nil {
+		log.Error("Failed to start Service", zap.String("name", service.Name), zap.Error(err))
+		return
+	}
+	var redirect *portListener
+	var redirectHandler http.Handler
+	if service.Data.Tls.Enabled() && service.Data.Tls.RedirectPort > 0 {
+		redirect, err = getListener(service.Data.Tls.RedirectPort, false)
 		if err != nil {
-			if !errors.Is(err, http.ErrServerClosed) {
-				log.Error("port  is in use,connect closed.", zap.Int("port", service.Data.Port))
-			} else {
-				log.Error("Failed to start Service", zap.String("name", service.Name), zap.Error(err))
-			}
+			log.Error("Failed to start https redirect", zap.String("name", service.Name), zap.Error(err))
 		}
+		// 开启 ACME 时 redirect_port 同时处理 HTTP-01 验证
+		redirectHandler = http.HandlerFunc(service.redirectToHttps)
+		if service.acmeManager != nil {
+			redirectHandler = service.acmeManager.httpHandler(redirectHandler)
+		}
+	}
+	rules := service.compileRoutes()
+	for _, serverName := range service.serverNames() {
+		host, pathPrefix := splitServerName(serverName)
+		hostRules := rules
+		if pathPrefix != "" && len(service.Data.Routes) == 0 {
+			hostRules = []*routeRule{{RouteConfig: config.RouteConfig{PathPrefix: pathPrefix}}}
+		}
+		listener.handle(host, service, hostRules, service.handleRequest)
+		if redirect != nil {
+			//重定向端口上不区分路径，保证 HTTP-01 验证请求能到达
+			redirect.handle(host, service, []*routeRule{nil}, redirectHandler.ServeHTTP)
+		}
+	}
+	if service.Data.DefaultServer {
+		listener.handleDefault(service, rules, service.handleRequest)
+		if redirect != nil {
+			redirect.handleDefault(service, []*routeRule{nil}, redirectHandler.ServeHTTP)
+		}
+	}
+	if service.acmeManager != nil {
+		go service.acmeManager.run()
+	}
 
-	}()
-
+	log.Info("Start service ", zap.String("name", service.Name), zap.Int("port", service.Data.Port), zap.Bool("tls", service.Data.Tls.Enabled()))
 }
 
 func (service *Service) Start() {
 	// 根据配置启动服务实例，并添加到 ServicesMap 中
-	if service.Instances == nil {
-		instances := make([]*Instance, service.Data.InstanceCount)
-		service.Instances = instances
+	if service.Instances() == nil {
+		service.storeInstances(make([]*Instance, service.Data.InstanceCount))
 	} else {
 		//如果已经存在，就不要继续了
 		//fmt.Println("Service Started already!")
@@ -97,7 +194,7 @@ func (service *Service) Start() {
 	}
 
 	for i := 0; i < service.Data.InstanceCount; i++ {
-		if service.Instances[i] == nil {
+		if service.Instances()[i] == nil {
 			//create new instance
 			port := service.Data.StartInstancePort + i
 			// 启动服务实例
@@ -106,42 +203,67 @@ func (service *Service) Start() {
 				log.Error("Failed to start service instance:", zap.Error(err))
 				continue
 			}
-			instance := &Instance{Pid: pid, Port: port, Status: StatusRunning}
-			service.Instances[i] = instance
+			instance := newInstance(pid, port)
+			service.setInstance(i, instance)
+			service.markRunning(instance)
 		} else {
 			//已经存在老的实例
-			instance := service.Instances[i]
-			if instance.Status == StatusStopped && instance.NeedRestart != true {
+			instance := service.Instances()[i]
+			if instance.Status.Load() == StatusStopped && !instance.NeedRestart.Load() {
 				//如果已被停止，而且没有处于自动重启的状态
 				newPid, err := service.StartInstance(instance.Port, service.Data.ExecutablePath)
 				if err != nil {
 
 					log.Error("start instance failed", zap.Error(err), zap.Int("port", instance.Port), zap.String("path", service.Data.ExecutablePath))
-					return
+					continue
 				}
-				instance.Pid = newPid
+				instance.setPid(newPid)
+				instanceRestarts.Inc(service.Name, strconv.Itoa(instance.Port))
 				//启动后等几秒钟再使其进入可服务状态，没有监听instance的cmd输出内容来判断，因为不希望那么耦合
-				instance.Status = StatusWillRunning
+				instance.Status.Store(StatusWillRunning)
 				time.Sleep(time.Duration(service.Data.DelayRunningTime) * time.Second)
-				instance.Status = StatusRunning
+				service.markRunning(instance)
 			}
 		}
 
 	}
 
 }
+
+// Instances 服务的所有实例，还没有启动的位置为 nil
+func (service *Service) Instances() []*Instance {
+	if instances := service.instances.Load(); instances != nil {
+		return *instances
+	}
+	return nil
+}
+
+func (service *Service) storeInstances(instances []*Instance) {
+	service.instances.Store(&instances)
+}
+
+// setInstance 复制一份实例列表再替换，正在遍历旧列表的请求不受影响
+func (service *Service) setInstance(index int, instance *Instance) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	instances := append([]*Instance(nil), service.Instances()...)
+	instances[index] = instance
+	service.storeInstances(instances)
+}
+
+// SelectInstance 轮询选择一个可以服务、没有达到并发上限的实例，并占用它的一个位置，用完后要调用 releaseInstance
 func (service *Service) SelectInstance() *Instance {
-	if len(service.Instances) == 0 {
+	instances := service.Instances()
+	instanceCount := len(instances)
+	if instanceCount == 0 {
 		return nil
 	}
 
-	instanceCount := len(service.Instances)
-	service.instanceIndex = (service.instanceIndex) % instanceCount // 更新索引，实现轮询
-
+	// 原子地取下一个索引实现轮询，请求之间不需要加锁
+	next := int(service.instanceIndex.Add(1) % uint64(instanceCount))
 	for i := 0; i < instanceCount; i++ {
-		instance := service.Instances[service.instanceIndex]
-		service.instanceIndex = (service.instanceIndex + 1) % instanceCount // 更新索引，实现轮询
-		if instance.Status >= StatusWaitingStop {
+		instance := instances[(next+i)%instanceCount]
+		if instance != nil && instance.Status.Load() >= StatusWaitingStop && service.acquireInstance(instance) {
 			return instance
 		}
 	}
@@ -150,58 +272,164 @@ func (service *Service) SelectInstance() *Instance {
 }
 
 func (service *Service) StartInstance(port int, executablePath string) (string, error) {
-	// 启动指定的 HTTP 服务器进程，并传递端口号作为参数
-	cmd := exec.Command(executablePath, fmt.Sprintf("-port=%d", port))
+	// 设置合适的环境变量等
+	data := service.instanceConfig.Load()
+	env, err := service.buildEnv(data, port)
+	if err != nil {
+		log.Error("build instance environment failed", zap.String("service", service.Name), zap.Int("port", port), zap.Error(err))
+		return "", err
+	}
+
+	// 启动指定的 HTTP 服务器进程，并按 args 模板传递端口号等参数
+	args, err := service.buildArgs(data, port, env)
+	if err != nil {
+		log.Error("build instance arguments failed", zap.String("service", service.Name), zap.Int("port", port), zap.Error(err))
+		return "", err
+	}
+	cmd := exec.Command(executablePath, args...)
 	cmd.Dir = filepath.Dir(executablePath)
+	cmd.Env = env
+	if err = service.setCredential(cmd, data); err != nil {
+		log.Error("set instance user and group failed", zap.String("service", service.Name), zap.Int("port", port), zap.Error(err))
+		return "", err
+	}
 
-	// 设置合适的环境变量等
+	limits, err := service.prepareLimits(cmd, data, port)
+	if err != nil {
+		log.Error("prepare instance resource limits failed", zap.String("service", service.Name), zap.Int("port", port), zap.Error(err))
+		return "", err
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	setProcessGroup(cmd)
+	// 通过 /bin/sh 设置 umask，需要 rlimit 时让实例等设置好以后再 exec
+	ready, err := useLauncher(cmd, data.Umask, limits.needsRlimit())
+	if err != nil {
+		log.Error("prepare instance launcher failed", zap.String("service", service.Name), zap.Int("port", port), zap.Error(err))
+		limits.exited()
+		return "", err
+	}
 
-	// 启动命令
-	if err = cmd.Start(); err != nil {
-		log.Error("start instance failed", zap.String("cmd", cmd.String()), zap.Error(err))
+	// 自己创建管道而不用 StdoutPipe，这样进程组里有残留进程占着输出时，Wait 也能在主进程退出后返回
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		releaseLauncher(cmd, ready, false)
+		limits.exited()
 		return "", err
 	}
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdout.Close()
+		_ = stdoutWriter.Close()
+		releaseLauncher(cmd, ready, false)
+		limits.exited()
+		return "", err
+	}
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
 
-	Screen := bufio.NewScanner(stdout)
+	checksum := fileChecksum(executablePath)
+	tail := newOutputTail(service.Data.CrashLogLines)
 
-	go func() {
-		for Screen.Scan() {
-			fmt.Println(Screen.Text())
-		}
-	}()
+	// 启动命令
+	startTime := time.Now()
+	err = cmd.Start()
+	_ = stdoutWriter.Close()
+	_ = stderrWriter.Close()
+	if err != nil {
+		log.Error("start instance failed", zap.String("cmd", cmd.String()), zap.Error(err))
+		_ = stdout.Close()
+		_ = stderr.Close()
+		releaseLauncher(cmd, ready, false)
+		limits.exited()
+		return "", err
+	}
+	if err = limits.started(cmd.Process.Pid); err != nil {
+		//没有限制的实例不能运行：等待 rlimit 的实例读不到就绪信号会自己退出，已经 exec 的直接杀掉
+		log.Error("set instance resource limits failed", zap.String("service", service.Name), zap.Int("port", port), zap.Error(err))
+		releaseLauncher(cmd, ready, false)
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		_ = stdout.Close()
+		_ = stderr.Close()
+		limits.exited()
+		return "", err
+	}
+	releaseLauncher(cmd, ready, true)
+
+	// stdout 和 stderr 都输出到屏幕，同时保留最后几行用于崩溃记录
+	var outputWg sync.WaitGroup
+	for _, pipe := range []*os.File{stdout, stderr} {
+		outputWg.Add(1)
+		go func(pipe *os.File) {
+			defer outputWg.Done()
+			defer pipe.Close()
+			screen := bufio.NewScanner(pipe)
+			for screen.Scan() {
+				fmt.Println(screen.Text())
+				tail.Add(screen.Text())
+			}
+		}(pipe)
+	}
 
 	// 获取进程 ID
 	pid := fmt.Sprintf("%d", cmd.Process.Pid)
 
 	// 等待进程退出
 	go func() {
-		if err := cmd.Wait(); err != nil {
+		waitErr := cmd.Wait()
+		if waitErr != nil {
+			log.Error("Service Instance process exited with error:", zap.Error(waitErr))
+		}
 
-			log.Error("Service Instance process exited with error:", zap.Error(err))
+		//确认进程组里没有残留的子进程占着端口，再继续后面的重启
+		if sweepGroup(cmd.Process.Pid, service.stopTimeout()) {
+			log.Error("Service instance left processes in its group, killed them", zap.String("service", service.Name), zap.String("pid", pid))
 		}
+		//进程组清理干净后管道会被关闭，等剩余的输出读完，崩溃记录里才有最后几行
+		waitOutput(&outputWg, time.Second)
+
+		oomKilled := limits.exited()
 
 		//查看当前是不是实例是不是需要重启
 		instance := service.getInstance(pid)
 
-		if instance.Status == StatusStopping {
+		if instance == nil || instance.Status.Load() != StatusStopping {
+			//不是由 smoothserve 停止的，记录崩溃现场
+			record := newCrashRecord(service, port, pid, cmd.ProcessState, waitErr, startTime, checksum, tail)
+			if oomKilled {
+				record.OOMKilled = true
+				record.Reason = "killed by OOM killer, memory limit " + data.Limits.MaxMemory
+			}
+			service.recordCrash(record)
+			log.Error("Service instance exited unexpectedly", zap.String("service", service.Name), zap.Int("port", port),
+				zap.String("pid", pid), zap.Int("exit_code", record.ExitCode), zap.String("reason", record.Reason),
+				zap.String("runtime", record.Runtime))
+		}
+		if instance == nil {
+			return
+		}
+
+		if instance.Status.Load() == StatusStopping {
 			//被彻底停止，现在需要被重启
-			instance.Status = StatusStopped
+			instance.Status.Store(StatusStopped)
 
-			if instance.NeedRestart {
+			if instance.NeedRestart.Load() {
 				newPid, err := service.StartInstance(instance.Port, service.Data.ExecutablePath)
 				if err != nil {
 
+					//启动失败的实例保持停止状态，继续重启下一个，不能让整个滚动重启卡住
 					log.Error("start instance error ", zap.Error(err))
+					instance.NeedRestart.Store(false)
+					service.stopOne()
 					return
 				}
-				instance.Pid = newPid
+				instance.setPid(newPid)
+				instanceRestarts.Inc(service.Name, strconv.Itoa(instance.Port))
 				//启动后等几秒钟再使其进入可服务状态，没有监听instance的cmd输出内容来判断，因为不希望那么耦合
-				instance.Status = StatusWillRunning
+				instance.Status.Store(StatusWillRunning)
 				time.Sleep(time.Duration(service.Data.DelayRunningTime) * time.Second)
-				instance.Status = StatusRunning
-				instance.NeedRestart = false
+				service.markRunning(instance)
+				instance.NeedRestart.Store(false)
 				//启动以后再开始停止下一个
 				service.stopOne()
 			} else {
@@ -221,30 +449,69 @@ func (service *Service) StartInstance(port int, executablePath string) (string,
 	return pid, nil
 }
 func (service *Service) handleRequest(w http.ResponseWriter, r *http.Request) {
-	// 选择一个服务实例处理请求
-	service.mutex.Lock()
-	defer service.mutex.Unlock()
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+
+	// 请求 ID 转发给实例，并在响应、访问日志和错误页里带上
+	requestId := service.requestId(r)
+	r.Header.Set(service.requestIdHeader(), requestId)
+	if service.access.reject(w, r, requestId) || service.serveMaintenance(w, r, requestId) || service.applyRewrites(w, r, requestId) || service.checkRateLimits(w, r, requestId) {
+		return
+	}
+	if !service.enterConcurrency() {
+		service.rejectRequest(w, r, http.StatusServiceUnavailable, "Service concurrency limit reached", requestId, "concurrency", service.concurrencyRetryAfter())
+		return
+	}
+
+	// 选择一个服务实例处理请求，没有可用实例时排队等待
 	instance := service.SelectInstance()
 	if instance == nil {
-		http.Error(w, "No available instance", http.StatusServiceUnavailable)
+		instance = service.waitForInstance(r.Context())
+	}
+	if instance == nil && service.instancesBusy() {
+		service.leaveConcurrency()
+		service.rejectRequest(w, r, http.StatusServiceUnavailable, "Instance concurrency limit reached", requestId, "instance_concurrency", service.concurrencyRetryAfter())
 		return
 	}
-
-	// 构建代理地址 目前仅支持本地的ip,因为服务启动过的方式就是通过调用本地命令行执行的，如果要支持代理到不同的服务器，则还需要增加远程启动服务的方式，目前没有这个需求就不加了。
-	proxyURL := fmt.Sprintf("%s:%d", service.Data.ServerIp, instance.Port)
-
-	// 创建反向代理
-	rp := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = "http"
-			req.URL.Host = proxyURL
-			req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
-			req.Host = instance.Host // 更新 Host，确保正确代理
-		},
+	if instance == nil {
+		service.leaveConcurrency()
+		requestsTotal.Inc(service.Name, "none", statusClass(http.StatusServiceUnavailable))
+		service.writeError(recorder, r, http.StatusServiceUnavailable, "No available instance", requestId)
+		service.accessLog.Log(service.newAccessEntry(r, recorder, start, requestId))
+		return
 	}
-
-	// 执行反向代理
-	rp.ServeHTTP(w, r)
+	service.bufferRequestBody(r)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	pc := &proxyContext{in: r, instance: instance, upstreamPid: instance.Pid(), upstream: service.upstreamAddr(instance), requestId: requestId, cancel: cancel}
+	recorder.onHijack = pc.attachConn
+
+	// 执行反向代理，同时统计请求数、状态码和耗时，记录访问日志；重试时按最后处理请求的实例统计
+	// 长连接单独统计连接数，不计入请求耗时
+	inFlightPort := strconv.Itoa(instance.Port)
+	requestsInFlight.Inc(service.Name, inFlightPort)
+	defer func() {
+		requestsInFlight.Dec(service.Name, inFlightPort)
+		service.releaseSlots(pc)
+		service.untrackLongConn(pc)
+		port := strconv.Itoa(pc.instance.Port)
+		requestsTotal.Inc(service.Name, port, statusClass(recorder.Status()))
+		if pc.longConn == nil {
+			requestDuration.Observe(time.Since(start).Seconds(), service.Name, port)
+		}
+		entry := service.newAccessEntry(r, recorder, start, requestId)
+		entry.UpstreamPort = pc.instance.Port
+		entry.UpstreamPid = pc.upstreamPid
+		entry.Retries = pc.retries
+		service.accessLog.Log(entry)
+	}()
+	if service.compression == nil {
+		service.proxy.ServeHTTP(recorder, withProxyContext(r.WithContext(ctx), pc))
+		return
+	}
+	writer := service.compression.newWriter(recorder, r)
+	service.proxy.ServeHTTP(writer, withProxyContext(r.WithContext(ctx), pc))
+	writer.Close()
 }
 func (service *Service) initWatcher() {
 	// 创建新的fsnotify watcher
@@ -260,6 +527,13 @@ func (service *Service) initWatcher() {
 
 	rootDir := filepath.Dir(service.Data.ExecutablePath)
 
+	// 证书文件变化时只重新加载证书，不重启实例
+	service.watchPaths = make(map[string]bool)
+	for _, path := range service.Data.WatchFiles {
+		service.watchPaths[filepath.Join(rootDir, path)] = true
+	}
+	service.watchCertificate(watcher, service.watchPaths)
+
 	// 向Watcher添加要监视的文件和文件夹路径
 	for _, path := range service.Data.WatchFiles {
 		absFilePath := filepath.Join(rootDir, path)
@@ -286,6 +560,13 @@ func (service *Service) initWatcher() {
 					return
 				}
 				log.Info("Event:", zap.String("name", event.Name), zap.String("Op", event.Op.String()))
+				if service.isCertificateFile(event.Name) {
+					service.scheduleCertificateReload()
+					continue
+				}
+				if service.inCertificateDir(event.Name) {
+					continue
+				}
 
 				//
 				//if event.Op&fsnotify.Write == fsnotify.Write ||
@@ -320,8 +601,8 @@ func (service *Service) initWatcher() {
 }
 
 func (service *Service) getInstance(pid string) *Instance {
-	for _, instance := range service.Instances {
-		if instance != nil && instance.Pid == pid {
+	for _, instance := range service.Instances() {
+		if instance != nil && instance.Pid() == pid {
 			return instance
 		}
 	}
@@ -330,10 +611,18 @@ func (service *Service) getInstance(pid string) *Instance {
 
 func (service *Service) RestartOneByOne() {
 	log.Info("Restart service instance one by one.")
-	for _, instance := range service.Instances {
+	service.reloadInstanceConfig()
+	service.mutex.Lock()
+	service.rolloutStart = time.Now()
+	service.mutex.Unlock()
+	for _, instance := range service.Instances() {
+		//启动失败的位置是空的，没有需要重启的实例
+		if instance == nil {
+			continue
+		}
 		//先标记为都需要停止
-		instance.Status = StatusWaitingStop
-		instance.NeedRestart = true
+		instance.Status.Store(StatusWaitingStop)
+		instance.NeedRestart.Store(true)
 	}
 
 	//开始停止第一个
@@ -341,11 +630,57 @@ func (service *Service) RestartOneByOne() {
 
 }
 
+// reloadInstanceConfig 重新读取配置文件里和启动实例相关的设置，滚动重启时新实例使用新的设置
+// 复制一份修改后整体替换，不修改 service.Data，处理请求的 goroutine 读配置时不需要加锁
+func (service *Service) reloadInstanceConfig() {
+	if service.Data.ConfigFile == "" {
+		return
+	}
+	serviceData, err := config.LoadServiceData(service.Data.ConfigFile)
+	if err != nil {
+		log.Error("reload service config failed, keep the old settings", zap.String("service", service.Name), zap.Error(err))
+		return
+	}
+	if err = config.ValidateInstanceSettings(serviceData); err != nil {
+		log.Error("reloaded service config is invalid, keep the old settings", zap.String("service", service.Name), zap.Error(err))
+		return
+	}
+	data := *service.instanceConfig.Load()
+	data.Env = serviceData.Env
+	data.EnvFile = serviceData.EnvFile
+	data.SecretFiles = serviceData.SecretFiles
+	data.Args = serviceData.Args
+	data.PortEnv = serviceData.PortEnv
+	data.User = serviceData.User
+	data.Group = serviceData.Group
+	data.Groups = serviceData.Groups
+	data.Umask = serviceData.Umask
+	data.Limits = serviceData.Limits
+	if err = service.checkInstanceConfig(&data); err != nil {
+		log.Error("reloaded instance settings can not start an instance, keep the old settings", zap.String("service", service.Name), zap.Error(err))
+		return
+	}
+	service.instanceConfig.Store(&data)
+}
+
+// checkInstanceConfig 按新的设置试着生成环境变量、命令行参数和用户，
+// 避免滚动重启停掉旧实例以后才发现 env_file 读不了或者 args 模板写错，新实例起不来
+func (service *Service) checkInstanceConfig(data *config.ServiceData) error {
+	env, err := service.buildEnv(data, data.StartInstancePort)
+	if err != nil {
+		return err
+	}
+	if _, err = service.buildArgs(data, data.StartInstancePort, env); err != nil {
+		return err
+	}
+	return service.setCredential(&exec.Cmd{}, data)
+}
+
 func (service *Service) stopOne() {
 	var selectedInstance *Instance
-	for _, instance := range service.Instances {
+	for _, instance := range service.Instances() {
 		//先标记为都需要停止
-		if instance.Status == StatusWaitingStop {
+		if instance != nil && instance.Status.Load() == StatusWaitingStop {
 			selectedInstance = instance
 			break
 		}
@@ -356,30 +691,40 @@ func (service *Service) stopOne() {
 		//已经没有需要停止的了
 
 		log.Info("all instance stopped ")
+		service.mutex.Lock()
+		rolloutStart := service.rolloutStart
+		service.rolloutStart = time.Time{}
+		service.mutex.Unlock()
+		observeRollout(service, rolloutStart)
 
 		return
 	}
 
-	//开始停止第一个
-	selectedInstance.Status = StatusStopping
-	err := service.StopInstance(selectedInstance.Pid)
-	if err != nil {
-		log.Error("stop instance failed,pid:", zap.String("pid", selectedInstance.Pid), zap.Error(err))
-		return
-	}
+	//开始停止第一个，不再接收新请求，等实例上的长连接结束后再停止
+	selectedInstance.Status.Store(StatusStopping)
+	go func() {
+		service.drainLongConns(selectedInstance)
+		err := service.StopInstance(selectedInstance.Pid())
+		if err != nil {
+			log.Error("stop instance failed,pid:", zap.String("pid", selectedInstance.Pid()), zap.Error(err))
+			//停不掉的实例继续服务，接着重启下一个
+			selectedInstance.NeedRestart.Store(false)
+			selectedInstance.Status.Store(StatusRunning)
+			service.stopOne()
+			return
+		}
+	}()
 
 }
 
 func (service *Service) StopInstance(pid string) error {
-	// 停止指定进程
-	cmd := exec.Command("kill", "-TERM", pid)
-	err := cmd.Run()
+	// 停止指定进程所在的整个进程组
+	processId, err := strconv.Atoi(pid)
+	if err == nil {
+		err = terminateGroup(processId)
+	}
 	if err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) {
-
-			log.Error("exit instance error", zap.String("error", exitErr.ProcessState.String()))
-		}
+		log.Error("exit instance error", zap.String("pid", pid), zap.Error(err))
 		if service.stopWg != nil {
 			service.stopWg.Done()
 		}
@@ -388,17 +733,44 @@ func (service *Service) StopInstance(pid string) error {
 	return nil
 }
 
+// stopTimeout 实例退出后等待进程组里剩余进程退出的时间，超时后强制杀掉
+func (service *Service) stopTimeout() time.Duration {
+	if service.Data.StopTimeout > 0 {
+		return time.Duration(service.Data.StopTimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func waitOutput(wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
 // Stop
 // 停止所有的实例
 func (service *Service) Stop() {
 	service.stopWg = new(sync.WaitGroup)
-	for _, instance := range service.Instances {
-		instance.Status = StatusStopping
+	for _, instance := range service.Instances() {
+		//空的位置和启动失败的实例没有进程，不需要等待
+		if instance == nil || instance.Status.Load() == StatusStopped {
+			continue
+		}
+		//取消还没有完成的滚动重启，实例退出后释放 stopWg
+		instance.NeedRestart.Store(false)
+		instance.Status.Store(StatusStopping)
 		service.stopWg.Add(1)
-		err := service.StopInstance(instance.Pid)
+		err := service.StopInstance(instance.Pid())
 		if err != nil {
+			//StopInstance 已经释放了这个实例的 stopWg，继续停止其他实例
 			log.Error("Stop instance got error", zap.Error(err))
-			return
+			continue
 		}
 	}
 	service.stopWg.Wait()
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"smoothserver/config"
+	"strconv"
+	"testing"
+)
+
+// newTestService 用 httptest 的服务器代替实例，data 里的 ServerIp 和 InstanceCount 由这里设置
+func newTestService(t *testing.T, data config.ServiceData, upstreams ...*httptest.Server) *Service {
+	t.Helper()
+	if data.Name == "" {
+		data.Name = "test"
+	}
+	data.ServerIp = "127.0.0.1"
+	data.InstanceCount = len(upstreams)
+	data = validatedData(t, data)
+	service := New(data)
+	instances := make([]*Instance, len(upstreams))
+	for i, upstream := range upstreams {
+		instances[i] = newInstance(strconv.Itoa(1000+i), upstreamPort(t, upstream))
+		service.markRunning(instances[i])
+	}
+	service.storeInstances(instances)
+	return service
+}
+
+func upstreamPort(t *testing.T, upstream *httptest.Server) int {
+	t.Helper()
+	_, port, err := net.SplitHostPort(upstream.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := strconv.Atoi(port)
+	return value
+}
+
+// serve 把请求交给服务处理，返回记录下来的响应
+func serve(service *Service, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	service.handleRequest(w, r)
+	return w
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"smoothserver/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staticInstance 静态文件请求在指标里的 instance 标签
+const staticInstance = "static"
+
+// precompressedEncodings 预压缩文件的扩展名，按优先顺序
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticHandler 直接返回目录里的文件，不经过实例
+type staticHandler struct {
+	service *Service
+	config  config.StaticConfig
+	root    string
+}
+
+func (service *Service) newStaticHandler(staticConfig config.StaticConfig) *staticHandler {
+	if len(staticConfig.Index) == 0 {
+		staticConfig.Index = []string{"index.html"}
+	}
+	return &staticHandler{service: service, config: staticConfig, root: service.resolvePath(staticConfig.Root)}
+}
+
+// ServeHTTP 和代理的请求一样带上请求 ID，统计指标并记录访问日志
+func (handler *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := handler.service
+	requestId := service.requestId(r)
+	//限流和转发的请求一样；concurrency 只限制转发给实例的请求，静态文件不占用
+	if service.access.reject(w, r, requestId) || service.serveMaintenance(w, r, requestId) || service.checkRateLimits(w, r, requestId) {
+		return
+	}
+	start := time.Now()
+	recorder := newResponseRecorder(w)
+	recorder.Header().Set(service.requestIdHeader(), requestId)
+	applyHeaderRules(recorder.Header(), service.Data.Rewrite.ResponseHeaders)
+
+	handler.serve(recorder, r, requestId)
+
+	requestsTotal.Inc(service.Name, staticInstance, statusClass(recorder.Status()))
+	requestDuration.Observe(time.Since(start).Seconds(), service.Name, staticInstance)
+	service.accessLog.Log(service.newAccessEntry(r, recorder, start, requestId))
+}
+
+func (handler *staticHandler) serve(w http.ResponseWriter, r *http.Request, requestId string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		handler.service.writeError(w, r, http.StatusMethodNotAllowed, "Method Not Allowed", requestId)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	file, info, err := handler.open(name)
+	if err == nil && info.IsDir() {
+		file.Close()
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// 相对地址，去掉了前缀的路由也能重定向到正确的地址
+			target := path.Base(name) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		file, info, name, err = handler.openIndex(name)
+	}
+	if err != nil && handler.config.SpaFallback != "" {
+		name = path.Clean("/" + handler.config.SpaFallback)
+		file, info, err = handler.open(name)
+	}
+	if err != nil || info.IsDir() {
+		if err == nil {
+			file.Close()
+		}
+		handler.service.writeError(w, r, http.StatusNotFound, "Not Found", requestId)
+		return
+	}
+	defer file.Close()
+
+	header := w.Header()
+	contentType := mime.TypeByExtension(path.Ext(name))
+	etagSuffix := ""
+	if handler.config.Precompressed {
+		header.Add("Vary", "Accept-Encoding")
+		for _, variant := range precompressedEncodings {
+			if !acceptsEncoding(r, variant.encoding) {
+				continue
+			}
+			compressed, compressedInfo, err := handler.open(name + variant.extension)
+			if err != nil {
+				continue
+			}
+			if compressedInfo.IsDir() {
+				compressed.Close()
+				continue
+			}
+			file.Close()
+			file, info = compressed, compressedInfo
+			header.Set("Content-Encoding", variant.encoding)
+			etagSuffix = "-" + variant.encoding
+			if contentType == "" {
+				//不能让 ServeContent 按压缩后的内容猜类型
+				contentType = "application/octet-stream"
+			}
+			break
+		}
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("ETag", fmt.Sprintf(`"%x-%x%s"`, info.ModTime().UnixNano(), info.Size(), etagSuffix))
+	if cacheControl := handler.cacheControl(name); cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+	// ServeContent 处理 If-None-Match、If-Modified-Since、Range 和 HEAD
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// open 打开 root 下的文件，name 是以 / 开头的干净路径，不会跳出 root；隐藏文件（如 .env、.git）不对外提供，.well-known 除外
+func (handler *staticHandler) open(name string) (*os.File, fs.FileInfo, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+	file, err := os.Open(filepath.Join(handler.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// openIndex 请求目录时依次尝试 index 里的文件
+func (handler *staticHandler) openIndex(dir string) (*os.File, fs.FileInfo, string, error) {
+	for _, index := range handler.config.Index {
+		name := path.Join(dir, index)
+		file, info, err := handler.open(name)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			file.Close()
+			continue
+		}
+		return file, info, name, nil
+	}
+	return nil, nil, "", fs.ErrNotExist
+}
+
+// cacheControl 第一条匹配文件名的规则
+func (handler *staticHandler) cacheControl(name string) string {
+	for _, rule := range handler.config.CacheControl {
+		target := path.Base(name)
+		if strings.Contains(rule.Match, "/") {
+			target = name
+		}
+		if matched, _ := path.Match(rule.Match, target); matched {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+// acceptsEncoding 客户端的 Accept-Encoding 是否接受这种编码，q=0 表示不接受；单独列出的编码优先于 *
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(strings.Join(r.Header.Values("Accept-Encoding"), ","), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		exact := strings.EqualFold(name, encoding)
+		if !exact && name != "*" {
+			continue
+		}
+		ok := true
+		for _, param := range strings.Split(params, ";") {
+			if q, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+					ok = false
+				}
+			}
+		}
+		if exact {
+			return ok
+		}
+		accepted = ok
+	}
+	return accepted
+}
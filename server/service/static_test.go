@@ -0,0 +1,203 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+)
+
+// staticFiles 在临时目录里建好一个前端站点，返回指向它的 handler
+func staticFiles(t *testing.T, staticConfig config.StaticConfig) *staticHandler {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"www/index.html":            "<h1>home</h1>",
+		"www/app.js":                "console.log(1)",
+		"www/app.js.br":             "brotli",
+		"www/app.js.gz":             "gzip",
+		"www/docs/start.html":       "start",
+		"www/docs/index.htm":        "docs index",
+		"www/assets/logo.svg":       "<svg/>",
+		"www/.env":                  "SECRET=1",
+		"www/.well-known/security":  "contact",
+		"www/nested/dir.html/inner": "not a file",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staticConfig.Root = "www"
+	service := &Service{Name: "test", Data: config.ServiceData{ExecutablePath: filepath.Join(dir, "app")}}
+	return service.newStaticHandler(staticConfig)
+}
+
+func serveStatic(handler *staticHandler, method string, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler.serve(recorder, r, "req-1")
+	return recorder
+}
+
+func TestStaticFiles(t *testing.T) {
+	handler := staticFiles(t, config.StaticConfig{Index: []string{"index.html", "index.htm"}})
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		status   int
+		body     string
+		location string
+	}{
+		{name: "index", method: http.MethodGet, target: "/", status: http.StatusOK, body: "<h1>home</h1>"},
+		{name: "second index name", method: http.MethodGet, target: "/docs/", status: http.StatusOK, body: "docs index"},
+		{name: "directory without slash", method: http.MethodGet, target: "/docs?page=1", status: http.StatusMovedPermanently, location: "/docs/?page=1"},
+		{name: "file", method: http.MethodGet, target: "/docs/start.html", status: http.StatusOK, body: "start"},
+		{name: "head has no body", method: http.MethodHead, target: "/app.js", status: http.StatusOK},
+		{name: "path cannot leave root", method: http.MethodGet, target: "/../app", status: http.StatusNotFound},
+		{name: "hidden file", method: http.MethodGet, target: "/.env", status: http.StatusNotFound},
+		{name: "well-known is served", method: http.MethodGet, target: "/.well-known/security", status: http.StatusOK, body: "contact"},
+		{name: "missing file", method: http.MethodGet, target: "/missing.js", status: http.StatusNotFound},
+		{name: "post", method: http.MethodPost, target: "/app.js", status: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serveStatic(handler, test.method, test.target, nil)
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if test.body != "" && recorder.Body.String() != test.body {
+				t.Errorf("body = %q, want %q", recorder.Body.String(), test.body)
+			}
+			if test.method == http.MethodHead && recorder.Body.Len() != 0 {
+				t.Errorf("HEAD body = %q", recorder.Body.String())
+			}
+			if location := recorder.Header().Get("Location"); location != test.location {
+				t.Errorf("Location = %q, want %q", location, test.location)
+			}
+		})
+	}
+	if allow := serveStatic(handler, http.MethodPut, "/", nil).Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("Allow = %q", allow)
+	}
+}
+
+func TestStaticETag(t *testing.T) {
+	handler := staticFiles(t, config.StaticConfig{})
+	first := serveStatic(handler, http.MethodGet, "/app.js", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag = %q", first.Code, etag)
+	}
+
+	cached := serveStatic(handler, http.MethodGet, "/app.js", map[string]string{"If-None-Match": etag})
+	if cached.Code != http.StatusNotModified || cached.Body.Len() != 0 {
+		t.Errorf("If-None-Match with the current ETag = %d %q, want 304", cached.Code, cached.Body.String())
+	}
+
+	//文件变化后 ETag 随之变化，旧的 ETag 不再命中
+	if err := os.WriteFile(filepath.Join(handler.root, "app.js"), []byte("console.log(22)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := serveStatic(handler, http.MethodGet, "/app.js", map[string]string{"If-None-Match": etag})
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("after change status = %d, ETag = %q, want 200 and a new ETag", changed.Code, changed.Header().Get("ETag"))
+	}
+}
+
+func TestStaticSpaFallback(t *testing.T) {
+	handler := staticFiles(t, config.StaticConfig{SpaFallback: "index.html"})
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{target: "/users/42", status: http.StatusOK, body: "<h1>home</h1>"},
+		{target: "/app.js", status: http.StatusOK, body: "console.log(1)"},
+		{target: "/.env", status: http.StatusOK, body: "<h1>home</h1>"}, //隐藏文件按不存在处理
+		{target: "/nested/dir.html/", status: http.StatusOK, body: "<h1>home</h1>"},
+	}
+	for _, test := range tests {
+		recorder := serveStatic(handler, http.MethodGet, test.target, nil)
+		if recorder.Code != test.status || recorder.Body.String() != test.body {
+			t.Errorf("GET %s = %d %q, want %d %q", test.target, recorder.Code, recorder.Body.String(), test.status, test.body)
+		}
+		if test.body == "<h1>home</h1>" && !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("GET %s Content-Type = %q", test.target, recorder.Header().Get("Content-Type"))
+		}
+	}
+
+	missing := staticFiles(t, config.StaticConfig{SpaFallback: "missing.html"})
+	if recorder := serveStatic(missing, http.MethodGet, "/users/42", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("missing fallback status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	handler := staticFiles(t, config.StaticConfig{Precompressed: true})
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{name: "brotli preferred", acceptEncoding: "gzip, br", encoding: "br", body: "brotli"},
+		{name: "gzip only", acceptEncoding: "gzip", encoding: "gzip", body: "gzip"},
+		{name: "br refused", acceptEncoding: "br;q=0, *", encoding: "gzip", body: "gzip"},
+		{name: "identity", acceptEncoding: "", encoding: "", body: "console.log(1)"},
+	}
+	etags := make(map[string]string)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serveStatic(handler, http.MethodGet, "/app.js", map[string]string{"Accept-Encoding": test.acceptEncoding})
+			header := recorder.Header()
+			if header.Get("Content-Encoding") != test.encoding || recorder.Body.String() != test.body {
+				t.Errorf("Content-Encoding = %q, body = %q, want %q %q", header.Get("Content-Encoding"), recorder.Body.String(), test.encoding, test.body)
+			}
+			if !strings.Contains(header.Get("Content-Type"), "javascript") {
+				t.Errorf("Content-Type = %q, want the type of app.js", header.Get("Content-Type"))
+			}
+			if header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q", header.Get("Vary"))
+			}
+			etags[test.encoding] = header.Get("ETag")
+		})
+	}
+	//不同编码的 ETag 不能相同，否则缓存会把 br 的内容给不支持的客户端
+	if etags["br"] == etags["gzip"] || etags["gzip"] == etags[""] {
+		t.Errorf("ETags = %v, want one per encoding", etags)
+	}
+}
+
+func TestStaticCacheControl(t *testing.T) {
+	handler := staticFiles(t, config.StaticConfig{CacheControl: []config.CacheControlRule{
+		{Match: "/assets/*", Value: "public, max-age=31536000, immutable"},
+		{Match: "*.html", Value: "no-cache"},
+		{Match: "*", Value: "max-age=60"},
+	}})
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "/assets/logo.svg", want: "public, max-age=31536000, immutable"},
+		{target: "/docs/start.html", want: "no-cache"},
+		{target: "/", want: "no-cache"}, //目录按 index 的文件名匹配
+		{target: "/app.js", want: "max-age=60"},
+	}
+	for _, test := range tests {
+		if got := serveStatic(handler, http.MethodGet, test.target, nil).Header().Get("Cache-Control"); got != test.want {
+			t.Errorf("GET %s Cache-Control = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"go_service_core/core/log"
+	"golang.org/x/crypto/acme"
+	"net"
+	"net/http"
+	"path/filepath"
+	"smoothserver/config"
+	"strconv"
+	"time"
+)
+
+// newTlsConfig 服务的 TLS 配置，证书每次握手时读取，替换证书不需要重新监听；开启 ACME 时证书由 acmeManager 管理
+func (service *Service) newTlsConfig() *tls.Config {
+	minVersion, _ := config.ParseTlsVersion(service.Data.Tls.MinVersion)
+	cipherSuites, _ := config.ParseCipherSuites(service.Data.Tls.CipherSuites)
+	if service.acmeManager != nil {
+		return &tls.Config{
+			MinVersion:     minVersion,
+			CipherSuites:   cipherSuites,
+			NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto}, //acme-tls/1 用于 TLS-ALPN-01 验证
+			GetCertificate: service.acmeManager.getCertificate,
+		}
+	}
+	return &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		NextProtos:   []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate := service.certificate.Load()
+			if certificate == nil {
+				return nil, fmt.Errorf("no certificate loaded for service %s", service.Name)
+			}
+			return certificate, nil
+		},
+	}
+}
+
+// loadCertificate 读取证书和私钥，成功后替换正在使用的证书，读取失败时继续使用旧的证书
+func (service *Service) loadCertificate() error {
+	certFile := service.resolvePath(service.Data.Tls.CertFile)
+	keyFile := service.resolvePath(service.Data.Tls.KeyFile)
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	service.certificate.Store(&certificate)
+	log.Info("certificate loaded", zap.String("service", service.Name), zap.String("cert_file", certFile))
+	return nil
+}
+
+// watchCertificate 把证书和私钥所在的目录加到 watcher 里
+// 证书一般是通过替换文件（或软链接）更新的，所以监视目录而不是文件本身
+func (service *Service) watchCertificate(watcher *fsnotify.Watcher, watchedPaths map[string]bool) {
+	if service.Data.Tls.CertFile == "" {
+		return
+	}
+	service.certDirs = make(map[string]bool)
+	for _, file := range []string{service.Data.Tls.CertFile, service.Data.Tls.KeyFile} {
+		dir := filepath.Dir(service.resolvePath(file))
+		if service.certDirs[dir] || watchedPaths[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			log.Error("Error adding certificate dir to watcher", zap.String("path", dir), zap.Error(err))
+			continue
+		}
+		service.certDirs[dir] = true
+	}
+}
+
+// isCertificateFile 文件变化事件是不是证书或私钥
+func (service *Service) isCertificateFile(name string) bool {
+	if service.Data.Tls.CertFile == "" {
+		return false
+	}
+	name = filepath.Clean(name)
+	return name == filepath.Clean(service.resolvePath(service.Data.Tls.CertFile)) ||
+		name == filepath.Clean(service.resolvePath(service.Data.Tls.KeyFile))
+}
+
+// inCertificateDir 只为证书监视的目录里的其它文件变化不需要重启实例，watch_files 里的文件除外
+func (service *Service) inCertificateDir(name string) bool {
+	name = filepath.Clean(name)
+	return service.certDirs[filepath.Dir(name)] && !service.watchPaths[name]
+}
+
+// scheduleCertificateReload 证书和私钥通常先后写入，等一会儿再一起读取
+func (service *Service) scheduleCertificateReload() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.certTimer != nil {
+		service.certTimer.Stop()
+	}
+	service.certTimer = time.AfterFunc(time.Second, func() {
+		if err := service.loadCertificate(); err != nil {
+			log.Error("reload certificate failed, keep the old one", zap.String("service", service.Name), zap.Error(err))
+		}
+	})
+}
+
+// redirectToHttps redirect_port 上的 HTTP 请求重定向到 HTTPS
+func (service *Service) redirectToHttps(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if service.Data.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(service.Data.Port))
+	}
+
+	//GET 和 HEAD 以外的请求使用 308，保留请求方法和请求体
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
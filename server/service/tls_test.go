@@ -0,0 +1,171 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"smoothserver/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate 生成一张自签名证书写到 dir 下的 cert.pem 和 key.pem
+func writeCertificate(t *testing.T, dir string, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tlsService(dir string) *Service {
+	return &Service{Name: "test", Data: config.ServiceData{
+		ExecutablePath: filepath.Join(dir, "app"),
+		Tls:            config.TlsConfig{CertFile: "cert.pem", KeyFile: "key.pem"},
+	}}
+}
+
+func loadedName(t *testing.T, service *Service) string {
+	t.Helper()
+	certificate, err := service.newTlsConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	service := tlsService(dir)
+	if _, err := service.newTlsConfig().GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Fatal("GetCertificate() without a loaded certificate should fail")
+	}
+
+	writeCertificate(t, dir, "old.example.com")
+	if err := service.loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if name := loadedName(t, service); name != "old.example.com" {
+		t.Fatalf("certificate = %s, want old.example.com", name)
+	}
+
+	//替换文件后重新读取，新的握手拿到新证书
+	writeCertificate(t, dir, "new.example.com")
+	if err := service.loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if name := loadedName(t, service); name != "new.example.com" {
+		t.Fatalf("certificate after reload = %s, want new.example.com", name)
+	}
+
+	//私钥写了一半读取失败，继续使用旧的证书
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.loadCertificate(); err == nil {
+		t.Fatal("loadCertificate() with a broken key should fail")
+	}
+	if name := loadedName(t, service); name != "new.example.com" {
+		t.Errorf("certificate after a failed reload = %s, want new.example.com", name)
+	}
+}
+
+func TestCertificateEvents(t *testing.T) {
+	dir := t.TempDir()
+	service := tlsService(dir)
+	service.certDirs = map[string]bool{dir: true}
+	service.watchPaths = map[string]bool{filepath.Join(dir, "app.yaml"): true}
+
+	tests := []struct {
+		name            string
+		path            string
+		certificateFile bool
+		certificateDir  bool
+	}{
+		{name: "cert file", path: filepath.Join(dir, "cert.pem"), certificateFile: true, certificateDir: true},
+		{name: "key file, unclean path", path: dir + "/./key.pem", certificateFile: true, certificateDir: true},
+		{name: "other file in cert dir", path: filepath.Join(dir, "cert.pem.tmp"), certificateDir: true},
+		{name: "watch_files entry in cert dir", path: filepath.Join(dir, "app.yaml")},
+		{name: "file elsewhere", path: filepath.Join(dir, "sub", "cert.pem")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := service.isCertificateFile(test.path); got != test.certificateFile {
+				t.Errorf("isCertificateFile() = %v, want %v", got, test.certificateFile)
+			}
+			if got := service.inCertificateDir(test.path); got != test.certificateDir {
+				t.Errorf("inCertificateDir() = %v, want %v", got, test.certificateDir)
+			}
+		})
+	}
+
+	service.Data.Tls = config.TlsConfig{}
+	if service.isCertificateFile(filepath.Join(dir, "cert.pem")) {
+		t.Error("isCertificateFile() without tls should be false")
+	}
+}
+
+func TestRedirectToHttps(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   int
+		method string
+		target string
+		want   string
+		status int
+	}{
+		{name: "default port", port: 443, method: http.MethodGet, target: "http://example.com:80/a?b=1", want: "https://example.com/a?b=1", status: http.StatusMovedPermanently},
+		{name: "custom port", port: 8443, method: http.MethodHead, target: "http://example.com/a", want: "https://example.com:8443/a", status: http.StatusMovedPermanently},
+		{name: "post keeps method", port: 443, method: http.MethodPost, target: "http://example.com/form", want: "https://example.com/form", status: http.StatusPermanentRedirect},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &Service{Name: "test", Data: config.ServiceData{Port: test.port}}
+			recorder := httptest.NewRecorder()
+			service.redirectToHttps(recorder, httptest.NewRequest(test.method, test.target, strings.NewReader("")))
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if location := recorder.Header().Get("Location"); location != test.want {
+				t.Errorf("Location = %s, want %s", location, test.want)
+			}
+		})
+	}
+}
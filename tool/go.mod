@@ -2,7 +2,7 @@ module smoothtool
 
 go 1.22.5
 
-replace smoothserver => ../server  //这样就可以在本地寻找包了
+replace smoothserver => ../server //这样就可以在本地寻找包了
 
 require smoothserver v0.0.0-00010101000000-000000000000
 
@@ -22,6 +22,7 @@ require (
 	github.com/subosito/gotenv v1.6.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
+	go.uber.org/zap v1.21.0 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
@@ -21,6 +21,7 @@ var (
 	start           string
 	restart         string
 	stop            string
+	crashes         string
 	smoothServeName string = "smoothserve"
 	smoothServePath string = "./smoothserve"
 )
@@ -33,6 +34,7 @@ func main() {
 	flag.StringVar(&start, "start", "", "-start service_name #启动某一个服务, 如果为all的话，启动全部")
 	flag.StringVar(&stop, "stop", "", "-stop service_name #停止某一个服务, 如果为all的话，停止全部")
 	flag.StringVar(&restart, "restart", "", "-restart service_name #无缝重启某一个服务, 如果为all的话，重启所有服务的实例")
+	flag.StringVar(&crashes, "crashes", "", "-crashes service_name #查看某一个服务实例的崩溃记录, 如果为all的话，查看所有服务")
 	flag.BoolVar(&force, "force", false, "-force 强制执行停止时使用，会直接杀死进程 -stop all -force true")
 	flag.StringVar(&configPath, "config", "./smoothserve.yaml", "smoothserve的配置文件，一般不要设置")
 
@@ -65,6 +67,29 @@ func main() {
 		return
 	}
 
+	if len(crashes) > 0 {
+		if crashes != "all" {
+			showCrashes(crashes)
+		} else {
+			showCrashes("")
+		}
+		return
+	}
+
+	//smoothtool maintenance on|off service_name，service_name 为 all 时切换所有服务
+	if flag.Arg(0) == "maintenance" {
+		if flag.NArg() != 3 || flag.Arg(1) != "on" && flag.Arg(1) != "off" {
+			fmt.Println("Usage: smoothtool maintenance on|off service_name")
+			os.Exit(1)
+		}
+		if flag.Arg(2) != "all" {
+			setMaintenance(flag.Arg(2), flag.Arg(1))
+		} else {
+			setMaintenance("", flag.Arg(1))
+		}
+		return
+	}
+
 	if len(restart) > 0 {
 		if restart != "all" {
 			restartService(restart)
@@ -255,6 +280,29 @@ func restartService(serviceName string) {
 	post(formData)
 }
 
+func showCrashes(serviceName string) {
+	formData := url.Values{}
+	formData.Set("action", "crashes")
+	formData.Set("service_name", serviceName)
+
+	_, err := post(formData)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func setMaintenance(serviceName string, state string) {
+	formData := url.Values{}
+	formData.Set("action", "maintenance")
+	formData.Set("service_name", serviceName)
+	formData.Set("state", state)
+
+	_, err := post(formData)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func post(data url.Values) (string, error) {
 	url := fmt.Sprintf("http://%s:%d", config.ConfigData.ProxyAddr, config.ConfigData.CommandPort)
 	fmt.Println("url:", url)